@@ -5,6 +5,7 @@
 package alpenhorn
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/subtle"
@@ -12,6 +13,7 @@ import (
 	"encoding/hex"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/davidlazar/go-crypto/encoding/base32"
 	"golang.org/x/crypto/nacl/box"
@@ -46,6 +48,60 @@ type addFriendRoundState struct {
 	ExtractSuccess   bool
 }
 
+// eraseLocked zeroes the round's identity private keys once the client
+// is done with the round. It assumes st.mu is locked.
+func (st *addFriendRoundState) eraseLocked() {
+	for _, k := range st.PrivateKeys {
+		if k != nil {
+			*k = ibe.IdentityPrivateKey{}
+		}
+	}
+	st.PrivateKeys = nil
+	st.IdentitySigs = nil
+	st.ExtractSuccess = false
+}
+
+func eraseAddFriendRounds(rounds []*addFriendRoundState) {
+	for _, st := range rounds {
+		st.mu.Lock()
+		st.eraseLocked()
+		st.mu.Unlock()
+	}
+}
+
+// roundRetention is how many rounds the client keeps state for. Rounds
+// are normally deleted once their mailbox is scanned; the retention window
+// catches rounds that never got that far.
+const roundRetention = 10
+
+// pruneAddFriendRounds deletes the state of rounds that are too old to
+// finish, as of the given round.
+func (c *Client) pruneAddFriendRounds(round uint32) {
+	var stale []*addFriendRoundState
+	c.mu.Lock()
+	for r, st := range c.addFriendRounds {
+		if r+roundRetention < round {
+			stale = append(stale, st)
+			delete(c.addFriendRounds, r)
+		}
+	}
+	c.mu.Unlock()
+
+	// st.mu is locked after c.mu is unlocked to match the lock order
+	// in sendAddFriendOnion.
+	eraseAddFriendRounds(stale)
+}
+
+func (c *Client) deleteAddFriendRound(st *addFriendRoundState) {
+	c.mu.Lock()
+	if c.addFriendRounds[st.Round] == st {
+		delete(c.addFriendRounds, st.Round)
+	}
+	c.mu.Unlock()
+
+	eraseAddFriendRounds([]*addFriendRoundState{st})
+}
+
 func (c *Client) addFriendMux() typesocket.Mux {
 	return typesocket.NewMux(map[string]interface{}{
 		"newround": c.newAddFriendRound,
@@ -61,6 +117,19 @@ func (c *Client) addFriendRoundError(conn typesocket.Conn, v coordinator.RoundEr
 }
 
 func (c *Client) newAddFriendRound(conn typesocket.Conn, v coordinator.NewRound) {
+	// Expired requests are dropped from disk when the client is persisted
+	// at the end of the round.
+	c.expireFriendRequests(v.Round)
+	c.pruneAddFriendRounds(v.Round)
+
+	// persistErr is reported after c.mu is unlocked.
+	var persistErr error
+	defer func() {
+		if persistErr != nil {
+			c.Handler.Error(persistErr)
+		}
+	}()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -100,6 +169,9 @@ func (c *Client) newAddFriendRound(conn typesocket.Conn, v coordinator.NewRound)
 		ConfigParent: newConfig,
 	}
 
+	if err := c.persistLocked(); err != nil {
+		persistErr = c.persistFailedLocked(err)
+	}
 }
 
 // assumes c.mu is locked
@@ -107,9 +179,8 @@ func (c *Client) loadAddFriendConfig(newConfig *config.SignedConfig) *config.Add
 	c.addFriendConfig = newConfig
 	c.addFriendConfigHash = newConfig.Hash()
 
-	// TODO do the right thing if the coordinator changes.
-
 	innerConfig := newConfig.Inner.(*config.AddFriendConfig)
+	c.followCoordinatorLocked("AddFriend", innerConfig.Coordinator)
 
 	pkgClient := &pkg.Client{
 		Username:        c.Username,
@@ -132,10 +203,6 @@ func (c *Client) loadAddFriendConfig(newConfig *config.SignedConfig) *config.Add
 		}
 	}
 
-	if err := c.persistLocked(); err != nil {
-		panic("failed to persist state: " + err.Error())
-	}
-
 	return innerConfig
 }
 
@@ -238,6 +305,10 @@ func (c *Client) sendAddFriendOnion(conn typesocket.Conn, v coordinator.MixRound
 		c.Handler.Error(errors.New("sendAddFriendOnion: round %d: error parsing service data: %s", round, err))
 		return
 	}
+	if err := checkAddFriendServiceData(st.Config, serviceData); err != nil {
+		c.Handler.Error(errors.Wrap(err, "sendAddFriendOnion: round %d", round))
+		return
+	}
 	settingsMsg := v.MixSettings.SigningMessage()
 
 	for i, mixer := range st.Config.MixServers {
@@ -259,50 +330,116 @@ func (c *Client) sendAddFriendOnion(conn typesocket.Conn, v coordinator.MixRound
 		return
 	}
 
-	outgoingReq := c.nextOutgoingFriendRequest()
-	intro, sentReq := c.genIntro(st, outgoingReq)
+	// Don't take requests off the queue for a coordinator we left.
+	if !c.isCurrentConn("AddFriend", conn) {
+		return
+	}
+	// The sent request's DH key would be lost if we can't persist it.
+	if c.persistDegraded() {
+		log.WithFields(log.Fields{"round": round}).Warn("Skipping add-friend round: client state is not persisted")
+		return
+	}
+
+	masterKey := new(ibe.MasterPublicKey).Aggregate(st.ServerMasterKeys...)
+
+	// Fill every slot so the number of real requests doesn't leak.
+	numIntros := st.Config.NumIntros()
+	outgoingReqs := make([]*OutgoingFriendRequest, numIntros)
+	sentReqs := make([]*sentFriendRequest, numIntros)
+	onions := make([][]byte, numIntros)
+	for i := range onions {
+		outgoingReqs[i] = c.nextOutgoingFriendRequest()
+		var intro *introduction
+		intro, sentReqs[i] = c.genIntro(st, outgoingReqs[i])
+		onions[i] = c.sealAddFriendIntro(intro, sentReqs[i].Username, masterKey, serviceData, v)
+	}
+
+	for i, onion := range onions {
+		omsg := coordinator.OnionMsg{
+			Round: round,
+			Onion: onion,
+		}
+		if err := conn.Send("onion", omsg); err != nil {
+			// Put the unsent requests back so they're sent in a later round.
+			var unsent []*OutgoingFriendRequest
+			for j := i; j < len(onions); j++ {
+				if sentReqs[j].Username != "" {
+					unsent = append(unsent, outgoingReqs[j])
+				}
+			}
+			c.mu.Lock()
+			c.outgoingFriendRequests = append(unsent, c.outgoingFriendRequests...)
+			c.mu.Unlock()
+			c.Handler.Error(errors.Wrap(err, "round %d: sending onion", round))
+			sentReqs = sentReqs[:i]
+			break
+		}
+	}
+
+	for i, sentReq := range sentReqs {
+		if sentReq.Username == "" {
+			continue
+		}
+		c.Handler.SentFriendRequest(outgoingReqs[i])
+		inReq := c.matchToIncoming(sentReq)
+		if inReq != nil {
+			c.matchedFriendRequest(inReq, sentReq)
+		} else {
+			c.mu.Lock()
+			c.sentFriendRequests = append(c.sentFriendRequests, sentReq)
+			c.mu.Unlock()
+		}
+	}
+
+	// Always persist client to avoid side-channels.
+	if err := c.persistClient(); err != nil {
+		c.persistFailed(err)
+	}
+}
+
+// sealAddFriendIntro encrypts an intro to username and wraps it in an onion.
+// If username is empty, the onion carries a cover message instead.
+func (c *Client) sealAddFriendIntro(intro *introduction, username string, masterKey *ibe.MasterPublicKey, serviceData *addfriend.ServiceData, v coordinator.MixRound) []byte {
+	round := v.MixSettings.Round
 
 	var isReal int // 1 if real, 0 if cover
-	if sentReq.Username != "" {
+	if username != "" {
 		isReal = 1
 	} else {
 		isReal = 0
 	}
 
-	masterKey := new(ibe.MasterPublicKey).Aggregate(st.ServerMasterKeys...)
 	// Unsafe because "" is not a valid username, but this reduces timing leak:
-	id := pkg.ValidUsernameToIdentity(sentReq.Username)
+	id := pkg.ValidUsernameToIdentity(username)
 	encIntro := ibe.Encrypt(rand.Reader, masterKey, id[:], mustMarshal(intro))
 	encIntroBytes := mustMarshal(encIntro)
 
 	mixMessage := new(addfriend.MixMessage)
-	mixMessage.Mailbox = usernameToMailbox(sentReq.Username, serviceData.NumMailboxes)
+	mixMessage.Mailbox = usernameToMailbox(username, serviceData.NumMailboxes)
 	subtle.ConstantTimeCopy(isReal, mixMessage.EncryptedIntro[:], encIntroBytes)
 
 	onion, _ := onionbox.Seal(mustMarshal(mixMessage), mixnet.ForwardNonce(round), v.MixSettings.OnionKeys)
+	return onion
+}
 
-	omsg := coordinator.OnionMsg{
-		Round: round,
-		Onion: onion,
+// checkAddFriendServiceData returns an error if the coordinator's service
+// data disagrees with the signed config. The mixers use the service data,
+// so the coordinator could otherwise weaken a round's anonymity.
+func checkAddFriendServiceData(conf *config.AddFriendConfig, data *addfriend.ServiceData) error {
+	if !bytes.Equal(data.CDNKey, conf.CDNServer.Key) || data.CDNAddress != conf.CDNServer.Address {
+		return errors.New("service data has CDN %s, config has %s", data.CDNAddress, conf.CDNServer.Address)
 	}
-	conn.Send("onion", omsg)
-
-	if sentReq.Username != "" {
-		c.Handler.SentFriendRequest(outgoingReq)
-		inReq := c.matchToIncoming(sentReq)
-		if inReq != nil {
-			c.newFriend(inReq, sentReq)
-		} else {
-			c.mu.Lock()
-			c.sentFriendRequests = append(c.sentFriendRequests, sentReq)
-			c.mu.Unlock()
-		}
+	if conf.NumMailboxes != 0 && data.NumMailboxes != conf.NumMailboxes {
+		return errors.New("service data has %d mailboxes, config has %d", data.NumMailboxes, conf.NumMailboxes)
 	}
-
-	// Always persist client to avoid side-channels.
-	if err := c.persistClient(); err != nil {
-		panic(err)
+	intros := int(data.IntrosPerRound)
+	if intros == 0 {
+		intros = 1
+	}
+	if intros != conf.NumIntros() {
+		return errors.New("service data has %d intros per round, config has %d", intros, conf.NumIntros())
 	}
+	return nil
 }
 
 func (c *Client) nextOutgoingFriendRequest() *OutgoingFriendRequest {
@@ -338,9 +475,13 @@ func (c *Client) genIntro(st *addFriendRoundState, out *OutgoingFriendRequest) (
 		DialRound:    out.DialRound,
 
 		SentRound:    st.Round,
+		SentTime:     time.Now(),
 		DHPublicKey:  dhPublic,
 		DHPrivateKey: dhPrivate,
 
+		Verified: out.verified,
+		Rekey:    out.rekey,
+
 		client: c,
 	}
 	if !sent.Confirmation {
@@ -359,12 +500,22 @@ func (c *Client) genIntro(st *addFriendRoundState, out *OutgoingFriendRequest) (
 	multisig := bls.Aggregate(st.IdentitySigs...).Compress()
 	copy(intro.ServerMultisig[:], multisig[:])
 
-	intro.Sign(c.LongTermPrivateKey)
+	prefix := introPrefix
+	if out.rekey {
+		prefix = rekeyIntroPrefix
+	} else if out.inviteSecret != nil {
+		prefix = inviteIntroPrefix(out.inviteSecret)
+	}
+	intro.Sign(c.LongTermPrivateKey, prefix)
 
 	return intro, sent
 }
 
 func (c *Client) scanMailbox(conn typesocket.Conn, v coordinator.MailboxURL) {
+	if conn != nil && c.waitForCatchUp("AddFriend", v.Round) {
+		return
+	}
+
 	c.mu.Lock()
 	st, ok := c.addFriendRounds[v.Round]
 	c.mu.Unlock()
@@ -373,6 +524,17 @@ func (c *Client) scanMailbox(conn typesocket.Conn, v coordinator.MailboxURL) {
 		//c.Handler.Error(err)
 		return
 	}
+	if n := st.Config.NumMailboxes; n != 0 && v.NumMailboxes != n {
+		c.Handler.Error(errors.New("scanMailbox: round %d: coordinator announced %d mailboxes, config has %d", v.Round, v.NumMailboxes, n))
+		// Erase the round's identity keys.
+		c.deleteAddFriendRound(st)
+		return
+	}
+	// New friends and friend requests would be lost if we can't persist them.
+	if c.persistDegraded() {
+		log.WithFields(log.Fields{"round": v.Round}).Warn("Skipping add-friend mailbox: client state is not persisted")
+		return
+	}
 
 	mailboxID := usernameToMailbox(c.Username, v.NumMailboxes)
 	mailbox, err := c.fetchMailbox(st.Config.CDNServer, v.URL, mailboxID)
@@ -393,6 +555,8 @@ func (c *Client) scanMailbox(conn typesocket.Conn, v coordinator.MailboxURL) {
 	}
 	privKey := new(ibe.IdentityPrivateKey).Aggregate(st.PrivateKeys...)
 	st.mu.Unlock()
+	// This is the last step of the round.
+	defer c.deleteAddFriendRound(st)
 
 	intros := concurrency.Spans(len(mailbox), addfriend.SizeEncryptedIntro)
 	//log.WithFields(log.Fields{"round": v.Round, "intros": len(intros), "mailbox": mailboxID}).Info("Scanning mailbox")
@@ -411,40 +575,83 @@ func (c *Client) scanMailbox(conn typesocket.Conn, v coordinator.MailboxURL) {
 				continue
 			}
 
-			c.decodeAddFriendMessage(msg, st.Config.PKGServers, st.ServerBLSKeys)
+			c.decodeAddFriendMessage(v.Round, msg, st.Config.PKGServers, st.ServerBLSKeys)
 		}
 	})
+	*privKey = ibe.IdentityPrivateKey{}
+
+	c.mu.Lock()
+	if v.Round > c.lastAddFriendMailbox {
+		c.lastAddFriendMailbox = v.Round
+	}
+	c.mu.Unlock()
 
 	// Always persist client to avoid side-channels.
 	if err := c.persistClient(); err != nil {
-		panic(err)
+		c.persistFailed(err)
 	}
 }
 
-func (c *Client) decodeAddFriendMessage(msg []byte, verifiers []pkg.PublicServerConfig, multisigKeys []*bls.PublicKey) {
+func (c *Client) decodeAddFriendMessage(round uint32, msg []byte, verifiers []pkg.PublicServerConfig, multisigKeys []*bls.PublicKey) {
 	intro := new(introduction)
 	if err := intro.UnmarshalBinary(msg); err != nil {
 		return
 	}
 
-	if !intro.Verify(multisigKeys) {
+	secrets := c.inviteSecrets()
+	prefixes := [][]byte{introPrefix, rekeyIntroPrefix}
+	for _, secret := range secrets {
+		prefixes = append(prefixes, inviteIntroPrefix(secret))
+	}
+	kind := intro.Verify(multisigKeys, prefixes...)
+	if kind < 0 {
 		log.Warnf("failed to verify intro: %s", intro.Username)
 		return
 	}
+	rekey := kind == 1
+	var invite []byte
+	if kind >= 2 {
+		invite = secrets[kind-2]
+	}
 
 	username := pkg.IdentityToUsername(&intro.Username)
+	if c.isBlocked(username, intro.LongTermKey[:]) {
+		return
+	}
 	req := &IncomingFriendRequest{
 		Username:    username,
 		LongTermKey: intro.LongTermKey[:],
 		DHPublicKey: &intro.DHPublicKey,
 		DialRound:   intro.DialingRound,
 		Verifiers:   verifiers,
-		client:      c,
+
+		ReceivedRound: round,
+		ReceivedTime:  time.Now(),
+
+		client: c,
 	}
 
 	sentReq := c.matchToSent(req)
 	if sentReq != nil {
-		c.newFriend(req, sentReq)
+		c.matchedFriendRequest(req, sentReq)
+	} else if rekey && c.isRekeyRequest(req) {
+		c.mu.Lock()
+		c.incomingFriendRequests = append(c.incomingFriendRequests, req)
+		c.mu.Unlock()
+		// The friend already has the user's trust, so confirm the
+		// new secret without asking the application.
+		if _, err := req.approve(true, false); err != nil {
+			c.Handler.Error(errors.Wrap(err, "approving rekey request from %s", req.Username))
+		}
+	} else if invite != nil && c.useInvite(invite) {
+		c.mu.Lock()
+		c.incomingFriendRequests = append(c.incomingFriendRequests, req)
+		c.mu.Unlock()
+		// The user handed out the invite, so the request needs no
+		// approval and the friend is verified.
+		if _, err := req.approve(false, true); err != nil {
+			c.Handler.Error(errors.Wrap(err, "approving friend request from %s", req.Username))
+		}
 	} else {
 		c.mu.Lock()
 		c.incomingFriendRequests = append(c.incomingFriendRequests, req)
@@ -477,7 +684,7 @@ func (c *Client) matchToSent(inReq *IncomingFriendRequest) *sentFriendRequest {
 	return nil
 }
 
-func (c *Client) newFriend(in *IncomingFriendRequest, sent *sentFriendRequest) {
+func (c *Client) newFriend(in *IncomingFriendRequest, sent *sentFriendRequest) *Friend {
 	sharedKey := new([32]byte)
 	box.Precompute(sharedKey, in.DHPublicKey, sent.DHPrivateKey)
 	c.wheel.Put(in.Username, in.DialRound, sharedKey)
@@ -486,13 +693,40 @@ func (c *Client) newFriend(in *IncomingFriendRequest, sent *sentFriendRequest) {
 		Username:    in.Username,
 		LongTermKey: in.LongTermKey,
 
+		verified: sent.Verified && sent.ExpectedKey.Equal(in.LongTermKey),
+
 		client: c,
 	}
 
 	c.mu.Lock()
+	old := c.friends[in.Username]
+	keyChanged := old != nil && !old.LongTermKey.Equal(in.LongTermKey)
+	rekeyed := old != nil && !keyChanged && sent.Rekey
+	if rekeyed {
+		// Keep the application's Friend, along with its extra data.
+		old.verified = old.verified || friend.verified
+		friend = old
+	} else if old != nil && !keyChanged && old.verified {
+		friend.verified = true
+	}
 	c.friends[in.Username] = friend
+	c.removeFriendRequestsLocked(in, sent)
+	c.mu.Unlock()
 
-	// delete the friend requests from the in/sent queues (slice tricks)
+	if h, ok := c.Handler.(FriendKeyChangedHandler); ok && keyChanged {
+		h.FriendKeyChanged(friend, old.LongTermKey)
+	}
+	if h, ok := c.Handler.(FriendRekeyedHandler); ok && rekeyed {
+		h.FriendRekeyed(friend)
+	} else {
+		c.Handler.ConfirmedFriend(friend)
+	}
+	return friend
+}
+
+// removeFriendRequestsLocked deletes the friend requests from the
+// in/sent queues (slice tricks).
+func (c *Client) removeFriendRequestsLocked(in *IncomingFriendRequest, sent *sentFriendRequest) {
 	newIn := c.incomingFriendRequests[:0]
 	for _, req := range c.incomingFriendRequests {
 		if req != in {
@@ -508,9 +742,6 @@ func (c *Client) newFriend(in *IncomingFriendRequest, sent *sentFriendRequest) {
 		}
 	}
 	c.sentFriendRequests = newSent
-	c.mu.Unlock()
-
-	c.Handler.ConfirmedFriend(friend)
 }
 
 func mustMarshal(v encoding.BinaryMarshaler) []byte {
@@ -73,6 +73,10 @@ type ServiceData struct {
 	CDNKey       ed25519.PublicKey
 	CDNAddress   string
 	NumMailboxes uint32
+
+	// IntrosPerRound is the number of onions each client sends in
+	// the round. Zero means one.
+	IntrosPerRound uint32
 }
 
 const AddFriendServiceDataVersion = 0
@@ -84,10 +88,20 @@ func (srv *Mixer) ParseServiceData(data []byte) (interface{}, error) {
 }
 
 func (srv *Mixer) GenerateNoise(settings mixnet.RoundSettings, myPos int) [][]byte {
+	serviceData := settings.ServiceData.(*ServiceData)
+
+	// A client can put up to IntrosPerRound messages in one mailbox,
+	// so scale the noise to hide that many messages.
+	laplace := srv.Laplace
+	if k := serviceData.IntrosPerRound; k > 1 {
+		laplace.Mu *= float64(k)
+		laplace.B *= float64(k)
+	}
+
 	noiseTotal := uint32(0)
-	noiseCounts := make([]uint32, settings.ServiceData.(*ServiceData).NumMailboxes+1)
+	noiseCounts := make([]uint32, serviceData.NumMailboxes+1)
 	for b := range noiseCounts {
-		bmu := srv.Laplace.Uint32()
+		bmu := laplace.Uint32()
 		noiseCounts[b] = bmu
 		noiseTotal += bmu
 	}
@@ -6,29 +6,41 @@ package alpenhorn
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/boltdb/bolt"
+	"github.com/davidlazar/go-crypto/encoding/base32"
+	"golang.org/x/crypto/nacl/box"
+
 	"alpenhorn/internal/alplog"
 	"alpenhorn/internal/debug"
 	"alpenhorn/internal/mock"
 
 	// "alpenhorn/localInternal/internal/debug"
 
+	"alpenhorn/addfriend"
 	"alpenhorn/cdn"
 	"alpenhorn/config"
 	"alpenhorn/coordinator"
 	"alpenhorn/edtls"
+	"alpenhorn/errors"
 	"alpenhorn/log"
 	"alpenhorn/pkg"
 
+	"vuvuzela.io/crypto/ibe"
 	"vuvuzela.io/crypto/rand"
 )
 
@@ -41,6 +53,13 @@ type chanHandler struct {
 	sentCall              chan *OutgoingCall
 	receivedCall          chan *IncomingCall
 	newConfig             chan []*config.SignedConfig
+	connectionEvent       chan ConnectionEvent
+	unexpectedKey         chan *IncomingFriendRequest
+	keyChanged            chan *Friend
+	rekeyed               chan *Friend
+	expiredIncoming       chan *IncomingFriendRequest
+	expiredOutgoing       chan *OutgoingFriendRequest
+	errors                chan error
 }
 
 func newChanHandler(errPrefix string) *chanHandler {
@@ -52,11 +71,22 @@ func newChanHandler(errPrefix string) *chanHandler {
 		sentCall:              make(chan *OutgoingCall, 1),
 		receivedCall:          make(chan *IncomingCall, 1),
 		newConfig:             make(chan []*config.SignedConfig, 1),
+		connectionEvent:       make(chan ConnectionEvent, 16),
+		unexpectedKey:         make(chan *IncomingFriendRequest, 1),
+		keyChanged:            make(chan *Friend, 1),
+		rekeyed:               make(chan *Friend, 1),
+		expiredIncoming:       make(chan *IncomingFriendRequest, 4),
+		expiredOutgoing:       make(chan *OutgoingFriendRequest, 4),
+		errors:                make(chan error, 16),
 	}
 }
 
 func (h *chanHandler) Error(err error) {
 	log.Errorf(h.errPrefix+": client error: %s", err)
+	select {
+	case h.errors <- err:
+	default:
+	}
 }
 func (h *chanHandler) ConfirmedFriend(f *Friend) {
 	h.confirmedFriend <- f
@@ -76,8 +106,28 @@ func (h *chanHandler) ReceivedCall(call *IncomingCall) {
 func (h *chanHandler) NewConfig(configs []*config.SignedConfig) {
 	h.newConfig <- configs
 }
+func (h *chanHandler) ConnectionStateChanged(e ConnectionEvent) {
+	select {
+	case h.connectionEvent <- e:
+	default:
+		// Tests that don't use Run don't read connection events.
+	}
+}
+func (h *chanHandler) FriendRequestExpired(in *IncomingFriendRequest, out *OutgoingFriendRequest) {
+	if in != nil {
+		h.expiredIncoming <- in
+	} else {
+		h.expiredOutgoing <- out
+	}
+}
 func (h *chanHandler) UnexpectedSigningKey(in *IncomingFriendRequest, out *OutgoingFriendRequest) {
-	log.Fatalf("unexpected signing key for %s", in.Username)
+	h.unexpectedKey <- in
+}
+func (h *chanHandler) FriendKeyChanged(f *Friend, oldKey ed25519.PublicKey) {
+	h.keyChanged <- f
+}
+func (h *chanHandler) FriendRekeyed(f *Friend) {
+	h.rekeyed <- f
 }
 
 func (u *universe) newUser(username string) *Client {
@@ -206,6 +256,9 @@ func TestAliceFriendsThenCallsBob(t *testing.T) {
 	if !bytes.Equal(outCall.SessionKey()[:], inCall.SessionKey[:]) {
 		t.Fatal("Alice and Bob agreed on different keys!")
 	}
+	if !reflect.DeepEqual(outCall.DeriveKeys("test", 2), inCall.DeriveKeys("test", 2)) {
+		t.Fatal("Alice and Bob derived different keys!")
+	}
 
 	// Test persistence.
 	if err := bob.CloseAddFriend(); err != nil {
@@ -435,6 +488,2091 @@ func TestAliceFriendsThenCallsBob(t *testing.T) {
 	}
 }
 
+func TestMultipleIntrosPerRound(t *testing.T) {
+	u := createAlpenhornUniverse()
+	defer func() {
+		time.Sleep(1 * time.Second)
+		u.Destroy()
+	}()
+
+	alice := u.newUser("alice@example.org")
+	bob := u.newUser("bob@example.org")
+	carol := u.newUser("carol@example.org")
+	// The universe's config has two intros per round, so both requests
+	// should go out in the same round. Queue them before Alice connects
+	// so that they can't be split across rounds.
+	for _, username := range []string{bob.Username, carol.Username} {
+		if _, err := alice.SendFriendRequest(username, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, client := range []*Client{alice, bob, carol} {
+		if _, err := client.ConnectAddFriend(); err != nil {
+			t.Fatal(err)
+		}
+		defer client.CloseAddFriend()
+	}
+	<-alice.Handler.(*chanHandler).sentFriendRequest
+	<-alice.Handler.(*chanHandler).sentFriendRequest
+
+	alice.mu.Lock()
+	if len(alice.sentFriendRequests) != 2 {
+		alice.mu.Unlock()
+		t.Fatalf("alice has %d sent friend requests, want 2", len(alice.sentFriendRequests))
+	}
+	round0, round1 := alice.sentFriendRequests[0].SentRound, alice.sentFriendRequests[1].SentRound
+	alice.mu.Unlock()
+	if round0 != round1 {
+		t.Fatalf("friend requests were sent in rounds %d and %d", round0, round1)
+	}
+
+	<-bob.Handler.(*chanHandler).receivedFriendRequest
+	<-carol.Handler.(*chanHandler).receivedFriendRequest
+}
+
+func TestRunReconnects(t *testing.T) {
+	u := createAlpenhornUniverse()
+	defer func() {
+		time.Sleep(1 * time.Second)
+		u.Destroy()
+	}()
+
+	alice := u.newUser("alice@example.org")
+	h := alice.Handler.(*chanHandler)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- alice.Run(ctx)
+	}()
+
+	waitForState := func(service string, state ConnectionState) {
+		timeout := time.After(30 * time.Second)
+		for {
+			select {
+			case e := <-h.connectionEvent:
+				if e.Service == service && e.State == state {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for %s to be %s", service, state)
+			}
+		}
+	}
+
+	waitForState("AddFriend", Connected)
+	waitForState("Dialing", Connected)
+
+	// Simulate a dropped connection.
+	if err := alice.CloseAddFriend(); err != nil {
+		t.Fatal(err)
+	}
+	waitForState("AddFriend", BackingOff)
+	waitForState("AddFriend", Connected)
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("unexpected error from Run: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+}
+
+func TestFollowCoordinatorMove(t *testing.T) {
+	u := createAlpenhornUniverse()
+	defer func() {
+		time.Sleep(1 * time.Second)
+		u.Destroy()
+	}()
+
+	alice := u.newUser("alice@example.org")
+	bob := u.newUser("bob@example.org")
+	for _, client := range []*Client{alice, bob} {
+		if _, err := client.ConnectAddFriend(); err != nil {
+			t.Fatal(err)
+		}
+		defer client.CloseAddFriend()
+	}
+
+	// Queue a friend request before the move so we can check that
+	// it survives.
+	if _, err := alice.SendFriendRequest(bob.Username, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start a new addfriend coordinator with the same key at a new address.
+	// It continues the old coordinator's round numbers.
+	newAddr, newServer := u.launchAddFriendCoordinator(1000)
+	defer newServer.Close()
+
+	prevConfig := u.CurrentConfig("AddFriend")
+	prevInner := prevConfig.Inner.(*config.AddFriendConfig)
+	newConfig := &config.SignedConfig{
+		Version:        config.SignedConfigVersion,
+		Created:        time.Now(),
+		Expires:        time.Now().Add(24 * time.Hour),
+		PrevConfigHash: prevConfig.Hash(),
+
+		Service: "AddFriend",
+		Inner: &config.AddFriendConfig{
+			Version: config.AddFriendConfigVersion,
+			Coordinator: config.CoordinatorConfig{
+				Key:     u.CoordinatorKey,
+				Address: newAddr,
+			},
+			MixServers: prevInner.MixServers,
+			PKGServers: prevInner.PKGServers,
+			CDNServer:  prevInner.CDNServer,
+		},
+	}
+	if err := u.ConfigClient.SetCurrentConfig(newConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	// The friend request might have been sent before the move,
+	// so don't wait for the new configs in a fixed order.
+	friendRequest := func() *IncomingFriendRequest {
+		for {
+			select {
+			case <-alice.Handler.(*chanHandler).newConfig:
+			case <-bob.Handler.(*chanHandler).newConfig:
+			case <-alice.Handler.(*chanHandler).sentFriendRequest:
+			case r := <-bob.Handler.(*chanHandler).receivedFriendRequest:
+				return r
+			}
+		}
+	}()
+	if _, err := friendRequest.Approve(); err != nil {
+		t.Fatal(err)
+	}
+	<-bob.Handler.(*chanHandler).sentFriendRequest
+	<-bob.Handler.(*chanHandler).confirmedFriend
+	<-alice.Handler.(*chanHandler).confirmedFriend
+
+	// By now both clients have seen the new config and followed the move.
+	for _, client := range []*Client{alice, bob} {
+		client.mu.Lock()
+		addr := client.addFriendCoordinator.Address
+		client.mu.Unlock()
+		if addr != newAddr {
+			t.Fatalf("%s: connected to coordinator %s, want %s", client.Username, addr, newAddr)
+		}
+	}
+}
+
+// launchAddFriendCoordinator starts another addfriend coordinator with
+// the universe's coordinator key, starting at the given round.
+func (u *universe) launchAddFriendCoordinator(round uint32) (string, *coordinator.Server) {
+	listener, err := edtls.Listen("tcp", "localhost:0", u.coordinatorPrivateKey)
+	if err != nil {
+		log.Panicf("edtls.Listen: %s", err)
+	}
+
+	persistPath := filepath.Join(u.Dir, fmt.Sprintf("addfriend-coordinator-state-%d", round))
+	// This is coordinator/persist.go's format: a version byte followed by JSON.
+	state := append([]byte{1}, fmt.Sprintf(`{"Round": %d}`, round)...)
+	if err := ioutil.WriteFile(persistPath, state, 0600); err != nil {
+		log.Panic(err)
+	}
+
+	srv := &coordinator.Server{
+		Service:    "AddFriend",
+		PrivateKey: u.coordinatorPrivateKey,
+		Log: logger.WithFields(log.Fields{
+			"tag":     "coordinator2",
+			"service": "AddFriend",
+		}),
+
+		ConfigClient: u.ConfigClient,
+
+		PKGWait:      1 * time.Second,
+		MixWait:      1 * time.Second,
+		RoundWait:    2 * time.Second,
+		NumMailboxes: 1,
+
+		PersistPath: persistPath,
+	}
+	if err := srv.LoadPersistedState(); err != nil {
+		log.Panicf("error loading persisted state: %s", err)
+	}
+	if err := srv.Run(); err != nil {
+		log.Panicf("starting addfriend loop: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/addfriend/", http.StripPrefix("/addfriend", srv))
+	go func() {
+		err := http.Serve(listener, mux)
+		if err != nil {
+			log.Infof("http.Serve: %s", err)
+		}
+	}()
+
+	return listener.Addr().String(), srv
+}
+
+func TestCatchUpMissedRounds(t *testing.T) {
+	u := createAlpenhornUniverse()
+	defer func() {
+		time.Sleep(1 * time.Second)
+		u.Destroy()
+	}()
+
+	alice := u.newUser("alice@example.org")
+	lastMailbox := func() uint32 {
+		alice.mu.Lock()
+		defer alice.mu.Unlock()
+		return alice.lastDialingMailbox
+	}
+
+	if _, err := alice.ConnectDialing(); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(30 * time.Second)
+	for lastMailbox() == 0 {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for a dialing mailbox")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if err := alice.CloseDialing(); err != nil {
+		t.Fatal(err)
+	}
+	missedSince := lastMailbox()
+
+	// Wait for the coordinator to finish rounds without Alice.
+	time.Sleep(10 * time.Second)
+
+	alice.mu.Lock()
+	coordinatorConfig := alice.dialingCoordinator
+	configHash := alice.dialingConfigHash
+	alice.mu.Unlock()
+	history, err := alice.fetchHistory("Dialing", coordinatorConfig, missedSince)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Mailboxes) == 0 {
+		t.Fatalf("coordinator has no mailboxes after round %d", missedSince)
+	}
+	latest := missedSince
+	for _, mailbox := range history.Mailboxes {
+		if mailbox.Round <= missedSince {
+			t.Fatalf("history since round %d includes round %d", missedSince, mailbox.Round)
+		}
+		if mailbox.ConfigHash != configHash {
+			t.Fatalf("history has config %q for round %d, want %q", mailbox.ConfigHash, mailbox.Round, configHash)
+		}
+		if mailbox.Round > latest {
+			latest = mailbox.Round
+		}
+	}
+
+	alice.catchUp("Dialing")
+	if got := lastMailbox(); got < latest {
+		t.Fatalf("client caught up to round %d, want at least %d", got, latest)
+	}
+}
+
+// newOfflineClient returns a client bootstrapped with made-up configs.
+// It can't connect to any servers but is useful for testing local state.
+func newOfflineClient(username string) *Client {
+	serverKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	addFriendConfig := &config.SignedConfig{
+		Version: config.SignedConfigVersion,
+		Created: time.Now(),
+		Expires: time.Now().Add(24 * time.Hour),
+
+		Service: "AddFriend",
+		Inner: &config.AddFriendConfig{
+			Version: config.AddFriendConfigVersion,
+			Coordinator: config.CoordinatorConfig{
+				Key:     serverKey,
+				Address: "localhost:1",
+			},
+			CDNServer: config.CDNServerConfig{
+				Key:     serverKey,
+				Address: "localhost:2",
+			},
+		},
+	}
+	dialingConfig := &config.SignedConfig{
+		Version: config.SignedConfigVersion,
+		Created: time.Now(),
+		Expires: time.Now().Add(24 * time.Hour),
+
+		Service: "Dialing",
+		Inner: &config.DialingConfig{
+			Version: config.DialingConfigVersion,
+			Coordinator: config.CoordinatorConfig{
+				Key:     serverKey,
+				Address: "localhost:1",
+			},
+		},
+	}
+
+	userPub, userPriv, _ := ed25519.GenerateKey(rand.Reader)
+	client := &Client{
+		Username:           username,
+		LongTermPublicKey:  userPub,
+		LongTermPrivateKey: userPriv,
+		PKGLoginKey:        userPriv,
+
+		Handler: newChanHandler(username),
+	}
+	if err := client.Bootstrap(addFriendConfig, dialingConfig); err != nil {
+		log.Fatalf("client.Bootstrap: %s", err)
+	}
+	client.init()
+	return client
+}
+
+func TestEncryptedPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alpenhorn_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	alice := newOfflineClient("alice@example.org")
+	alice.ClientPersistPath = filepath.Join(dir, "alice-client")
+	alice.KeywheelPersistPath = filepath.Join(dir, "alice-keywheel")
+	alice.wheel.Put("bob@example.org", 100, new([32]byte))
+
+	if err := alice.SetPassphrase([]byte("hunter2")); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{alice.ClientPersistPath, alice.KeywheelPersistPath} {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isEncrypted(data) || bytes.Contains(data, []byte("example.org")) {
+			t.Fatalf("%s is not encrypted", path)
+		}
+	}
+
+	if _, err := LoadClient(alice.ClientPersistPath, alice.KeywheelPersistPath); err != ErrEncrypted {
+		t.Fatalf("LoadClient: got error %v, want %v", err, ErrEncrypted)
+	}
+	_, err = LoadClientWithPassphrase(alice.ClientPersistPath, alice.KeywheelPersistPath, []byte("hunter3"))
+	if err != ErrWrongPassphrase {
+		t.Fatalf("wrong passphrase: got error %v, want %v", err, ErrWrongPassphrase)
+	}
+
+	alice2, err := LoadClientWithPassphrase(alice.ClientPersistPath, alice.KeywheelPersistPath, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice2.Username != alice.Username || !bytes.Equal(alice2.LongTermPrivateKey, alice.LongTermPrivateKey) {
+		t.Fatal("loaded client does not match persisted client")
+	}
+	if !alice2.wheel.Exists("bob@example.org") {
+		t.Fatal("keywheel entry not found after loading client")
+	}
+
+	// Change the passphrase.
+	if err := alice2.SetPassphrase([]byte("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadClientWithPassphrase(alice.ClientPersistPath, alice.KeywheelPersistPath, []byte("hunter2"))
+	if err != ErrWrongPassphrase {
+		t.Fatalf("old passphrase: got error %v, want %v", err, ErrWrongPassphrase)
+	}
+	alice3, err := LoadClientWithPassphrase(alice.ClientPersistPath, alice.KeywheelPersistPath, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Switch to an application-supplied key.
+	key := new([32]byte)
+	rand.Read(key[:])
+	if err := alice3.SetPersistKey(key); err != nil {
+		t.Fatal(err)
+	}
+	alice4, err := LoadClientWithKey(alice.ClientPersistPath, alice.KeywheelPersistPath, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Turn off encryption.
+	if err := alice4.SetPersistKey(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadClient(alice.ClientPersistPath, alice.KeywheelPersistPath); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptedPersistenceDowngrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alpenhorn_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	alice := newOfflineClient("alice@example.org")
+	alice.ClientPersistPath = filepath.Join(dir, "alice-client")
+	alice.KeywheelPersistPath = filepath.Join(dir, "alice-keywheel")
+	if err := alice.Persist(); err != nil {
+		t.Fatal(err)
+	}
+	plainClient, err := ioutil.ReadFile(alice.ClientPersistPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainKeywheel, err := ioutil.ReadFile(alice.KeywheelPersistPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SetPassphrase([]byte("hunter2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A plaintext keywheel next to an encrypted client state.
+	if err := ioutil.WriteFile(alice.KeywheelPersistPath, plainKeywheel, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadClientWithPassphrase(alice.ClientPersistPath, alice.KeywheelPersistPath, []byte("hunter2"))
+	if err != ErrNotEncrypted {
+		t.Fatalf("plaintext keywheel: got error %v, want %v", err, ErrNotEncrypted)
+	}
+
+	// A plaintext client state next to an encrypted keywheel.
+	if err := alice.SetPassphrase([]byte("hunter2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(alice.ClientPersistPath, plainClient, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadClientWithPassphrase(alice.ClientPersistPath, alice.KeywheelPersistPath, []byte("hunter2"))
+	if err != ErrNotEncrypted {
+		t.Fatalf("plaintext client state: got error %v, want %v", err, ErrNotEncrypted)
+	}
+}
+
+// matchFriendRequest simulates an add-friend round in which client sends
+// a friend request to username expecting expectedKey, and then receives
+// a matching friend request signed with actualKey.
+// failingStore is a MemoryStore whose next fail writes of state name
+// fail.
+type failingStore struct {
+	MemoryStore
+	name string
+	fail int
+}
+
+func (s *failingStore) Put(name string, data []byte) error {
+	if name == s.name && s.fail > 0 {
+		s.fail--
+		return errors.New("failed to write %s", name)
+	}
+	return s.MemoryStore.Put(name, data)
+}
+
+func TestSetPassphraseRollback(t *testing.T) {
+	store := &failingStore{name: StateCallLog}
+	alice := newOfflineClient("alice@example.org")
+	alice.Store = store
+	alice.StoreCallLog = true
+	if err := alice.SetPassphrase([]byte("hunter2")); err != nil {
+		t.Fatal(err)
+	}
+	alice.logCall(CallRecord{Username: "bob@example.org", Round: 7, Time: time.Now()})
+	alice.finishDialingRound(&dialingRoundState{Round: 7})
+
+	// The client state and keywheel are written with the new key before
+	// the call log fails.
+	store.fail = 1
+	if err := alice.SetPassphrase([]byte("correct horse")); err == nil {
+		t.Fatal("expected error changing passphrase")
+	}
+
+	alice2, err := LoadClientFromStoreWithPassphrase(store, []byte("hunter2"))
+	if err != nil {
+		t.Fatalf("loading with the old passphrase: %s", err)
+	}
+	alice2.StoreCallLog = true
+	calls, err := alice2.CallHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0].Round != 7 {
+		t.Fatalf("unexpected call history: %s", debug.Pretty(calls))
+	}
+}
+
+func matchFriendRequest(client *Client, username string, expectedKey, actualKey ed25519.PublicKey) *IncomingFriendRequest {
+	myPub, myPriv, _ := box.GenerateKey(rand.Reader)
+	theirPub, _, _ := box.GenerateKey(rand.Reader)
+
+	sent := &sentFriendRequest{
+		Username:     username,
+		ExpectedKey:  expectedKey,
+		DialRound:    100,
+		SentRound:    10,
+		DHPublicKey:  myPub,
+		DHPrivateKey: myPriv,
+		client:       client,
+	}
+	client.mu.Lock()
+	client.sentFriendRequests = append(client.sentFriendRequests, sent)
+	client.mu.Unlock()
+
+	in := &IncomingFriendRequest{
+		Username:    username,
+		LongTermKey: actualKey,
+		DHPublicKey: theirPub,
+		DialRound:   100,
+		client:      client,
+	}
+	client.matchedFriendRequest(in, client.matchToSent(in))
+	return in
+}
+
+func TestExpectedKey(t *testing.T) {
+	alice := newOfflineClient("alice@example.org")
+	h := alice.Handler.(*chanHandler)
+	bobKey, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	matchFriendRequest(alice, "bob@example.org", bobKey, bobKey)
+	friend := <-h.confirmedFriend
+	if friend.Username != "bob@example.org" || !friend.LongTermKey.Equal(bobKey) {
+		t.Fatalf("unexpected friend: %s %x", friend.Username, friend.LongTermKey)
+	}
+}
+
+func TestUnexpectedSigningKeyAccept(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alpenhorn_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	alice := newOfflineClient("alice@example.org")
+	alice.ClientPersistPath = filepath.Join(dir, "alice-client")
+	alice.KeywheelPersistPath = filepath.Join(dir, "alice-keywheel")
+	h := alice.Handler.(*chanHandler)
+	expectedKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	actualKey, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	in := matchFriendRequest(alice, "bob@example.org", expectedKey, actualKey)
+	if got := <-h.unexpectedKey; got != in {
+		t.Fatalf("UnexpectedSigningKey called with wrong request: %#v", got)
+	}
+	if alice.GetFriend("bob@example.org") != nil {
+		t.Fatal("friend added before the unexpected key was accepted")
+	}
+	if len(alice.GetSentFriendRequests()) != 0 || len(alice.GetIncomingFriendRequests()) != 0 {
+		t.Fatal("held friend requests are still queued")
+	}
+	if err := alice.Persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The held request survives a restart.
+	alice2, err := LoadClient(alice.ClientPersistPath, alice.KeywheelPersistPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice2.Handler = newChanHandler("alice2")
+	held := alice2.GetUnexpectedKeyRequests()
+	if len(held) != 1 || !held[0].LongTermKey.Equal(actualKey) {
+		t.Fatalf("unexpected held requests after reload: %#v", held)
+	}
+
+	friend, err := held[0].AcceptUnexpectedKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !friend.LongTermKey.Equal(actualKey) {
+		t.Fatalf("friend has key %x, want %x", friend.LongTermKey, actualKey)
+	}
+	if alice2.GetFriend("bob@example.org") != friend {
+		t.Fatal("accepted friend not found")
+	}
+	if alice2.wheel.SessionKey("bob@example.org", 100) == nil {
+		t.Fatal("accepted friend has no shared key")
+	}
+	if len(alice2.GetUnexpectedKeyRequests()) != 0 {
+		t.Fatal("accepted request is still held")
+	}
+	if _, err := held[0].AcceptUnexpectedKey(); err != ErrTooLate {
+		t.Fatalf("second accept: got error %v, want %v", err, ErrTooLate)
+	}
+}
+
+func TestUnexpectedSigningKeyReject(t *testing.T) {
+	alice := newOfflineClient("alice@example.org")
+	h := alice.Handler.(*chanHandler)
+	expectedKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	actualKey, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	in := matchFriendRequest(alice, "bob@example.org", expectedKey, actualKey)
+	<-h.unexpectedKey
+
+	if err := in.RejectUnexpectedKey(); err != nil {
+		t.Fatal(err)
+	}
+	if alice.GetFriend("bob@example.org") != nil {
+		t.Fatal("rejected friend was added")
+	}
+	if len(alice.GetUnexpectedKeyRequests()) != 0 {
+		t.Fatal("rejected request is still held")
+	}
+	if alice.wheel.SessionKey("bob@example.org", 100) != nil {
+		t.Fatal("rejected friend has a shared key")
+	}
+	if err := in.RejectUnexpectedKey(); err != ErrTooLate {
+		t.Fatalf("second reject: got error %v, want %v", err, ErrTooLate)
+	}
+	if _, err := in.AcceptUnexpectedKey(); err != ErrTooLate {
+		t.Fatalf("accept after reject: got error %v, want %v", err, ErrTooLate)
+	}
+}
+
+func TestFriendRequestExpiry(t *testing.T) {
+	alice := newOfflineClient("alice@example.org")
+	alice.FriendRequestLifetime = FriendRequestLifetime{Rounds: 5, Duration: time.Hour}
+	h := alice.Handler.(*chanHandler)
+
+	bobDH, _, _ := box.GenerateKey(rand.Reader)
+	_, carolDH, _ := box.GenerateKey(rand.Reader)
+	fromBob := &IncomingFriendRequest{
+		Username:      "bob@example.org",
+		DHPublicKey:   bobDH,
+		ReceivedRound: 10,
+		ReceivedTime:  time.Now(),
+		client:        alice,
+	}
+	fromDave := &IncomingFriendRequest{
+		Username:      "dave@example.org",
+		DHPublicKey:   bobDH,
+		ReceivedRound: 14,
+		ReceivedTime:  time.Now().Add(-2 * time.Hour),
+		client:        alice,
+	}
+	// A request persisted before requests had timestamps.
+	fromEve := &IncomingFriendRequest{
+		Username:    "eve@example.org",
+		DHPublicKey: bobDH,
+		client:      alice,
+	}
+	toCarol := &sentFriendRequest{
+		Username:     "carol@example.org",
+		SentRound:    12,
+		SentTime:     time.Now(),
+		DHPrivateKey: carolDH,
+		client:       alice,
+	}
+	alice.incomingFriendRequests = []*IncomingFriendRequest{fromBob, fromDave, fromEve}
+	alice.sentFriendRequests = []*sentFriendRequest{toCarol}
+
+	alice.expireFriendRequests(14)
+	if in := <-h.expiredIncoming; in != fromDave {
+		t.Fatalf("expected request from dave to expire by time, got %s", in.Username)
+	}
+
+	alice.expireFriendRequests(15)
+	if in := <-h.expiredIncoming; in != fromBob {
+		t.Fatalf("expected request from bob to expire by rounds, got %s", in.Username)
+	}
+	if reqs := alice.GetIncomingFriendRequests(); len(reqs) != 1 || reqs[0] != fromEve {
+		t.Fatalf("unexpected incoming requests: %#v", reqs)
+	}
+	if len(alice.GetSentFriendRequests()) != 1 {
+		t.Fatal("sent request expired too early")
+	}
+
+	alice.expireFriendRequests(17)
+	if out := <-h.expiredOutgoing; out.Username != "carol@example.org" {
+		t.Fatalf("expected request to carol to expire, got %s", out.Username)
+	}
+	if *carolDH != [32]byte{} {
+		t.Fatal("DH private key of expired request was not zeroed")
+	}
+	if len(alice.GetSentFriendRequests()) != 0 {
+		t.Fatal("expired sent request is still queued")
+	}
+
+	// Eve's request started aging at round 14.
+	alice.expireFriendRequests(19)
+	if in := <-h.expiredIncoming; in != fromEve {
+		t.Fatalf("expected request from eve to expire, got %s", in.Username)
+	}
+	select {
+	case in := <-h.expiredIncoming:
+		t.Fatalf("unexpected expired request: %s", in.Username)
+	case out := <-h.expiredOutgoing:
+		t.Fatalf("unexpected expired request: %s", out.Username)
+	default:
+	}
+}
+
+func TestFriendRequestsNeverExpire(t *testing.T) {
+	alice := newOfflineClient("alice@example.org")
+
+	dh, _, _ := box.GenerateKey(rand.Reader)
+	in := &IncomingFriendRequest{
+		Username:      "bob@example.org",
+		DHPublicKey:   dh,
+		ReceivedRound: 1,
+		ReceivedTime:  time.Now().Add(-365 * 24 * time.Hour),
+		client:        alice,
+	}
+	alice.incomingFriendRequests = []*IncomingFriendRequest{in}
+
+	alice.expireFriendRequests(100000)
+	if reqs := alice.GetIncomingFriendRequests(); len(reqs) != 1 {
+		t.Fatal("request expired with a zero FriendRequestLifetime")
+	}
+}
+
+func TestRoundStateBounded(t *testing.T) {
+	alice := newOfflineClient("alice@example.org")
+
+	var keys []*ibe.IdentityPrivateKey
+	for round := uint32(1); round <= 5000; round++ {
+		alice.newAddFriendRound(nil, coordinator.NewRound{
+			Round:      round,
+			ConfigHash: alice.addFriendConfigHash,
+		})
+		alice.newDialingRound(nil, coordinator.NewRound{
+			Round:      round,
+			ConfigHash: alice.dialingConfigHash,
+		})
+
+		alice.mu.Lock()
+		st := alice.addFriendRounds[round]
+		alice.mu.Unlock()
+		key := new(ibe.IdentityPrivateKey)
+		keys = append(keys, key)
+		st.mu.Lock()
+		st.PrivateKeys = []*ibe.IdentityPrivateKey{key}
+		st.ExtractSuccess = true
+		st.mu.Unlock()
+
+		alice.mu.Lock()
+		numAddFriend, numDialing := len(alice.addFriendRounds), len(alice.dialingRounds)
+		alice.mu.Unlock()
+		if numAddFriend > roundRetention+1 || numDialing > roundRetention+1 {
+			t.Fatalf("round %d: client has state for %d add-friend rounds and %d dialing rounds",
+				round, numAddFriend, numDialing)
+		}
+	}
+
+	for i, key := range keys[:len(keys)-roundRetention-1] {
+		if !reflect.ValueOf(*key).IsZero() {
+			t.Fatalf("private key for round %d was not erased", i+1)
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	stream := NewEventStream(2)
+	stream.ConnectionStateChanged(ConnectionEvent{Service: "Dialing", State: Connecting})
+	stream.ConnectionStateChanged(ConnectionEvent{Service: "Dialing", State: Connected})
+	// The buffer is full, so the stream drops this event instead of blocking.
+	stream.Error(errors.New("dropped"))
+	if n := stream.Dropped(); n != 1 {
+		t.Fatalf("dropped %d events, want 1", n)
+	}
+
+	h := newChanHandler("stream")
+	for _, state := range []ConnectionState{Connecting, Connected} {
+		Dispatch(h, <-stream.Events())
+		e := <-h.connectionEvent
+		if e.Service != "Dialing" || e.State != state {
+			t.Fatalf("got %s %s, want Dialing %s", e.Service, e.State, state)
+		}
+	}
+
+	stream.Close()
+	stream.Error(errors.New("after close"))
+	if _, ok := <-stream.Events(); ok {
+		t.Fatal("received event after Close")
+	}
+	if n := stream.Dropped(); n != 2 {
+		t.Fatalf("dropped %d events, want 2", n)
+	}
+}
+
+// basicHandler implements only the methods in EventHandler.
+type basicHandler struct {
+	confirmedFriend []*Friend
+}
+
+func (h *basicHandler) Error(err error)                                                     {}
+func (h *basicHandler) ConfirmedFriend(f *Friend)                                           { h.confirmedFriend = append(h.confirmedFriend, f) }
+func (h *basicHandler) SentFriendRequest(r *OutgoingFriendRequest)                          {}
+func (h *basicHandler) ReceivedFriendRequest(r *IncomingFriendRequest)                      {}
+func (h *basicHandler) UnexpectedSigningKey(*IncomingFriendRequest, *OutgoingFriendRequest) {}
+func (h *basicHandler) SendingCall(call *OutgoingCall)                                      {}
+func (h *basicHandler) ReceivedCall(call *IncomingCall)                                     {}
+func (h *basicHandler) NewConfig(chain []*config.SignedConfig)                              {}
+
+func TestDispatchOptionalEvents(t *testing.T) {
+	h := new(basicHandler)
+	f := &Friend{Username: "bob@example.org"}
+	Dispatch(h, ConnectionEvent{Service: "Dialing", State: Connected})
+	Dispatch(h, FriendRequestExpiredEvent{Incoming: &IncomingFriendRequest{}})
+	Dispatch(h, FriendKeyChangedEvent{Friend: f})
+	if len(h.confirmedFriend) != 0 {
+		t.Fatalf("unexpected ConfirmedFriend calls: %d", len(h.confirmedFriend))
+	}
+
+	// Handlers without FriendRekeyed see a rekey as a confirmed friend.
+	Dispatch(h, FriendRekeyedEvent{Friend: f})
+	if len(h.confirmedFriend) != 1 || h.confirmedFriend[0] != f {
+		t.Fatalf("rekey not passed to ConfirmedFriend: %v", h.confirmedFriend)
+	}
+}
+
+func TestEventStreamKeepsCalls(t *testing.T) {
+	stream := NewEventStream(1)
+	stream.Error(errors.New("fills the buffer"))
+	calls := make([]*IncomingCall, 3)
+	for i := range calls {
+		calls[i] = &IncomingCall{Username: "bob@example.org", Intent: i}
+		stream.ReceivedCall(calls[i])
+	}
+	// Calls are queued, so this would overtake them.
+	stream.Error(errors.New("dropped"))
+	if n := stream.Dropped(); n != 1 {
+		t.Fatalf("dropped %d events, want 1", n)
+	}
+
+	if _, ok := (<-stream.Events()).(ErrorEvent); !ok {
+		t.Fatal("expected error event first")
+	}
+	for _, call := range calls {
+		e, ok := (<-stream.Events()).(ReceivedCallEvent)
+		if !ok || e.Call != call {
+			t.Fatalf("got %#v, want call with intent %d", e, call.Intent)
+		}
+	}
+
+	stream.ReceivedCall(calls[0])
+	stream.ReceivedCall(calls[1])
+	stream.Close()
+	for range stream.Events() {
+	}
+	if n := stream.Dropped(); n != 2 {
+		t.Fatalf("dropped %d events, want 2", n)
+	}
+}
+
+func TestEventStreamQueueLimit(t *testing.T) {
+	stream := NewEventStream(1)
+	stream.maxQueue = 2
+	stream.Error(errors.New("fills the buffer"))
+	calls := make([]*IncomingCall, 4)
+	for i := range calls {
+		calls[i] = &IncomingCall{Username: "bob@example.org", Intent: i}
+		stream.ReceivedCall(calls[i])
+	}
+	if n := stream.Dropped(); n != 2 {
+		t.Fatalf("dropped %d events, want 2", n)
+	}
+
+	<-stream.Events()
+	for _, call := range calls[:2] {
+		e, ok := (<-stream.Events()).(ReceivedCallEvent)
+		if !ok || e.Call != call {
+			t.Fatalf("got %#v, want call with intent %d", e, call.Intent)
+		}
+	}
+	if e, ok := (<-stream.Events()).(ErrorEvent); !ok || e.Err != ErrCallsDropped {
+		t.Fatalf("got %#v, want ErrCallsDropped", e)
+	}
+	stream.Close()
+}
+
+func TestCheckServiceData(t *testing.T) {
+	alice := newOfflineClient("alice@example.org")
+	conf := *alice.addFriendConfig.Inner.(*config.AddFriendConfig)
+	conf.Version = config.AddFriendConfigVersion
+	conf.NumMailboxes = 4
+	conf.IntrosPerRound = 2
+
+	good := &addfriend.ServiceData{
+		CDNKey:         conf.CDNServer.Key,
+		CDNAddress:     conf.CDNServer.Address,
+		NumMailboxes:   4,
+		IntrosPerRound: 2,
+	}
+	if err := checkAddFriendServiceData(&conf, good); err != nil {
+		t.Fatalf("rejected matching service data: %s", err)
+	}
+
+	bad := []func(d *addfriend.ServiceData){
+		func(d *addfriend.ServiceData) { d.NumMailboxes = 1 },
+		func(d *addfriend.ServiceData) { d.IntrosPerRound = 1 },
+		func(d *addfriend.ServiceData) { d.CDNAddress = "localhost:1" },
+	}
+	for i, modify := range bad {
+		d := *good
+		modify(&d)
+		if err := checkAddFriendServiceData(&conf, &d); err == nil {
+			t.Fatalf("case %d: accepted service data that disagrees with the config", i)
+		}
+	}
+
+	// Old configs leave the number of mailboxes to the coordinator.
+	conf.NumMailboxes = 0
+	d := *good
+	d.NumMailboxes = 1
+	if err := checkAddFriendServiceData(&conf, &d); err != nil {
+		t.Fatalf("rejected service data for config without mailboxes: %s", err)
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alpenhorn_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	alice := newOfflineClient("alice@example.org")
+	alice.ClientPersistPath = filepath.Join(dir, "alice-client")
+	alice.KeywheelPersistPath = filepath.Join(dir, "alice-keywheel")
+
+	spammerKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	alice.incomingFriendRequests = []*IncomingFriendRequest{
+		{Username: "bob@example.org", client: alice},
+		{Username: "eve@spam.example", client: alice},
+	}
+
+	for _, rule := range []BlockRule{{}, {Username: "*@"}, {Username: "Eve@spam.example"}} {
+		if err := alice.Block(rule); err == nil {
+			t.Fatalf("blocked invalid rule %+v", rule)
+		}
+	}
+	if err := alice.Block(BlockRule{Username: "*@spam.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Block(BlockRule{LongTermKey: spammerKey}); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := alice.GetIncomingFriendRequests()
+	if len(reqs) != 1 || reqs[0].Username != "bob@example.org" {
+		t.Fatalf("blocking did not remove pending requests: %s", debug.Pretty(reqs))
+	}
+
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	blocked := []struct {
+		username string
+		key      ed25519.PublicKey
+		want     bool
+	}{
+		{"eve@spam.example", otherKey, true},
+		{"mallory@example.org", spammerKey, true},
+		{"bob@example.org", otherKey, false},
+		{"eve@notspam.example", otherKey, false},
+	}
+	for _, b := range blocked {
+		if got := alice.isBlocked(b.username, b.key); got != b.want {
+			t.Fatalf("isBlocked(%s): got %v, want %v", b.username, got, b.want)
+		}
+	}
+
+	alice2, err := LoadClient(alice.ClientPersistPath, alice.KeywheelPersistPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(alice.GetBlocked(), alice2.GetBlocked()) {
+		t.Fatalf("blocklist changed after reload:\nbefore=%s\nafter=%s", debug.Pretty(alice.GetBlocked()), debug.Pretty(alice2.GetBlocked()))
+	}
+
+	if err := alice.Unblock(BlockRule{Username: "*@spam.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if alice.isBlocked("eve@spam.example", otherKey) {
+		t.Fatal("eve is still blocked after Unblock")
+	}
+	if err := alice.Unblock(BlockRule{Username: "*@spam.example"}); err == nil {
+		t.Fatal("expected error unblocking a rule that is not blocked")
+	}
+}
+
+func TestSafetyNumber(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alpenhorn_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	alice := newOfflineClient("alice@example.org")
+	alice.ClientPersistPath = filepath.Join(dir, "alice-client")
+	alice.KeywheelPersistPath = filepath.Join(dir, "alice-keywheel")
+	bob := newOfflineClient("bob@example.org")
+
+	befriend := func(c *Client, username string, key ed25519.PublicKey) *Friend {
+		dhPub, _, _ := box.GenerateKey(rand.Reader)
+		_, dhPriv, _ := box.GenerateKey(rand.Reader)
+		in := &IncomingFriendRequest{
+			Username:    username,
+			LongTermKey: key,
+			DHPublicKey: dhPub,
+			client:      c,
+		}
+		sent := &sentFriendRequest{
+			Username:     username,
+			DHPrivateKey: dhPriv,
+			client:       c,
+		}
+		f := c.newFriend(in, sent)
+		<-c.Handler.(*chanHandler).confirmedFriend
+		return f
+	}
+
+	aliceFriend := befriend(alice, bob.Username, bob.LongTermPublicKey)
+	bobFriend := befriend(bob, alice.Username, alice.LongTermPublicKey)
+
+	aliceNum := aliceFriend.SafetyNumber()
+	bobNum := bobFriend.SafetyNumber()
+	if aliceNum.Digits() != bobNum.Digits() {
+		t.Fatalf("safety numbers differ:\nalice=%s\nbob=%s", aliceNum, bobNum)
+	}
+	if len(aliceNum.Digits()) != 60+11 {
+		t.Fatalf("unexpected safety number format: %q", aliceNum.Digits())
+	}
+	if !bobNum.MatchesQR(aliceNum.QRPayload()) {
+		t.Fatal("QR payload does not match")
+	}
+	if aliceNum.Digits() != aliceFriend.SafetyNumber().Digits() {
+		t.Fatal("safety number is not stable")
+	}
+
+	if aliceFriend.Verified() {
+		t.Fatal("new friend is verified")
+	}
+	if err := aliceFriend.SetVerified(true); err != nil {
+		t.Fatal(err)
+	}
+	alice2, err := LoadClient(alice.ClientPersistPath, alice.KeywheelPersistPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !alice2.GetFriend(bob.Username).Verified() {
+		t.Fatal("verified flag was not persisted")
+	}
+
+	// Re-friending with the same key keeps the friend verified.
+	f := befriend(alice, bob.Username, bob.LongTermPublicKey)
+	if !f.Verified() {
+		t.Fatal("re-friending with the same key cleared the verified flag")
+	}
+
+	// Re-friending with a different key clears it.
+	newKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	f = befriend(alice, bob.Username, newKey)
+	select {
+	case changed := <-alice.Handler.(*chanHandler).keyChanged:
+		if changed != f {
+			t.Fatalf("unexpected friend in key-changed event: %s", changed.Username)
+		}
+	default:
+		t.Fatal("no key-changed event")
+	}
+	if f.Verified() {
+		t.Fatal("friend is still verified after key change")
+	}
+	if f.SafetyNumber().MatchesQR(aliceNum.QRPayload()) {
+		t.Fatal("safety number did not change with the key")
+	}
+}
+
+func TestInvite(t *testing.T) {
+	alice := newOfflineClient("alice@example.org")
+	bob := newOfflineClient("bob@example.org")
+
+	inv, err := bob.NewInvite(1 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qr, err := inv.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range [][]byte{[]byte(inv.String()), qr} {
+		got, err := ParseInvite(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, inv) {
+			t.Fatalf("invite changed after decoding:\nwant=%s\ngot=%s", debug.Pretty(inv), debug.Pretty(got))
+		}
+	}
+
+	tampered := append([]byte(nil), qr...)
+	tampered[len(tampered)-ed25519.SignatureSize-1] ^= 1
+	if _, err := ParseInvite(tampered); err == nil {
+		t.Fatal("accepted tampered invite")
+	}
+	expired, err := bob.NewInvite(-1 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseInvite([]byte(expired.String())); err == nil {
+		t.Fatal("accepted expired invite")
+	}
+	long := newOfflineClient(strings.Repeat("x", 256) + "@example.org")
+	if _, err := long.NewInvite(1 * time.Hour); err == nil {
+		t.Fatal("created invite for a username longer than 255 bytes")
+	}
+	if _, err := bob.AcceptInvite([]byte(inv.String())); err == nil {
+		t.Fatal("accepted own invite")
+	}
+
+	out, err := alice.AcceptInvite([]byte(inv.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Username != bob.Username || !out.ExpectedKey.Equal(bob.LongTermPublicKey) || !out.verified {
+		t.Fatalf("unexpected friend request: %s", debug.Pretty(out))
+	}
+
+	dhPub, _, _ := box.GenerateKey(rand.Reader)
+	_, dhPriv, _ := box.GenerateKey(rand.Reader)
+	in := &IncomingFriendRequest{
+		Username:    bob.Username,
+		LongTermKey: bob.LongTermPublicKey,
+		DHPublicKey: dhPub,
+		client:      alice,
+	}
+	sent := &sentFriendRequest{
+		Username:     out.Username,
+		ExpectedKey:  out.ExpectedKey,
+		Verified:     out.verified,
+		DHPrivateKey: dhPriv,
+		client:       alice,
+	}
+	friend := alice.newFriend(in, sent)
+	<-alice.Handler.(*chanHandler).confirmedFriend
+	if !friend.Verified() {
+		t.Fatal("friend added by invite is not verified")
+	}
+}
+
+func TestAcceptInvite(t *testing.T) {
+	u := createAlpenhornUniverse()
+	defer func() {
+		time.Sleep(1 * time.Second)
+		u.Destroy()
+	}()
+
+	alice := u.newUser("alice@example.org")
+	bob := u.newUser("bob@example.org")
+
+	inv, err := bob.NewInvite(1 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.AcceptInvite([]byte(inv.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []*Client{alice, bob} {
+		if _, err := c.ConnectAddFriend(); err != nil {
+			t.Fatal(err)
+		}
+		defer c.CloseAddFriend()
+	}
+
+	<-alice.Handler.(*chanHandler).sentFriendRequest
+	// Bob's client approves the request without asking Bob.
+	<-bob.Handler.(*chanHandler).sentFriendRequest
+	aliceFriend := <-alice.Handler.(*chanHandler).confirmedFriend
+	bobFriend := <-bob.Handler.(*chanHandler).confirmedFriend
+
+	if !aliceFriend.Verified() || !bobFriend.Verified() {
+		t.Fatalf("friends added by invite are not verified: alice=%t bob=%t", aliceFriend.Verified(), bobFriend.Verified())
+	}
+	if len(bob.inviteSecrets()) != 0 {
+		t.Fatal("invite was not used up")
+	}
+	select {
+	case req := <-bob.Handler.(*chanHandler).receivedFriendRequest:
+		t.Fatalf("invited friend request reached the application: %s", req.Username)
+	default:
+	}
+}
+
+func TestPersistAcceptInvite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alpenhorn_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bob := newOfflineClient("bob@example.org")
+	inv, err := bob.NewInvite(1 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := newOfflineClient("alice@example.org")
+	alice.ClientPersistPath = filepath.Join(dir, "alice-client")
+	alice.KeywheelPersistPath = filepath.Join(dir, "alice-keywheel")
+	if _, err := alice.AcceptInvite([]byte(inv.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	alice2, err := LoadClient(alice.ClientPersistPath, alice.KeywheelPersistPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := alice2.GetOutgoingFriendRequests()
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 outgoing friend request, got %d", len(reqs))
+	}
+	if !reqs[0].verified || !bytes.Equal(reqs[0].inviteSecret, inv.Secret) {
+		t.Fatalf("invite not persisted: verified=%t secret=%x", reqs[0].verified, reqs[0].inviteSecret)
+	}
+}
+
+func TestCallHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alpenhorn_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	alice := newOfflineClient("alice@example.org")
+	alice.ClientPersistPath = filepath.Join(dir, "alice-client")
+	alice.KeywheelPersistPath = filepath.Join(dir, "alice-keywheel")
+	alice.CallLogPersistPath = filepath.Join(dir, "alice-calls")
+	alice.CallLogSize = 3
+	if err := alice.SetPassphrase([]byte("hunter2")); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(time.Now().Unix(), 0).UTC()
+	for round := uint32(1); round <= 5; round++ {
+		alice.logCall(CallRecord{
+			Username: "bob@example.org",
+			Round:    round,
+			Intent:   int(round % 2),
+			Outgoing: round%2 == 0,
+			Missed:   round == 5,
+			Time:     now,
+		})
+	}
+	alice.finishDialingRound(&dialingRoundState{Round: 5})
+
+	calls, err := alice.CallHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 3 || calls[0].Round != 3 || calls[2].Round != 5 || !calls[2].Missed {
+		t.Fatalf("unexpected call history: %s", debug.Pretty(calls))
+	}
+
+	alice2, err := LoadClientWithPassphrase(alice.ClientPersistPath, alice.KeywheelPersistPath, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice2.CallLogPersistPath = alice.CallLogPersistPath
+	if alice2.lastDialingMailbox != 5 {
+		t.Fatalf("lastDialingMailbox not persisted with the keywheel: got %d, want 5", alice2.lastDialingMailbox)
+	}
+	calls2, err := alice2.CallHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(calls, calls2) {
+		t.Fatalf("call history changed after reload:\nbefore=%s\nafter=%s", debug.Pretty(calls), debug.Pretty(calls2))
+	}
+
+	if err := alice2.ClearCallHistory(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(alice.CallLogPersistPath); !os.IsNotExist(err) {
+		t.Fatalf("call log file still exists: %v", err)
+	}
+	calls, err = alice2.CallHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 0 {
+		t.Fatalf("call history not cleared: %s", debug.Pretty(calls))
+	}
+}
+
+func TestCallInvalidIntent(t *testing.T) {
+	alice := newOfflineClient("alice@example.org")
+	alice.wheel.Put("bob@example.org", 100, new([32]byte))
+	bob := &Friend{Username: "bob@example.org", client: alice}
+	carol := &Friend{Username: "carol@example.org", client: alice}
+
+	for _, intent := range []int{-1, IntentMax} {
+		if _, err := bob.CallIntent(intent); err != ErrInvalidIntent {
+			t.Fatalf("CallIntent(%d): expected ErrInvalidIntent, got %v", intent, err)
+		}
+		if call := bob.Call(intent); call != nil {
+			t.Fatalf("Call(%d): expected nil, got %#v", intent, call)
+		}
+	}
+	if _, err := carol.CallIntent(0); err == nil {
+		t.Fatal("called a friend with no keywheel entry")
+	}
+	if call := carol.Call(0); call != nil {
+		t.Fatalf("Call: expected nil for a friend with no keywheel entry, got %#v", call)
+	}
+	call, err := bob.CallIntent(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := alice.nextOutgoingCall(101); next != call {
+		t.Fatalf("expected queued call, got %#v", next)
+	}
+}
+
+func TestScheduledCalls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alpenhorn_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	alice := newOfflineClient("alice@example.org")
+	alice.ClientPersistPath = filepath.Join(dir, "alice-client")
+	alice.KeywheelPersistPath = filepath.Join(dir, "alice-keywheel")
+	alice.wheel.Put("bob@example.org", 100, new([32]byte))
+	bob := &Friend{Username: "bob@example.org", client: alice}
+	alice.friends[bob.Username] = bob
+
+	if _, err := bob.ScheduleCall(IntentMax, time.Now(), 0); err != ErrInvalidIntent {
+		t.Fatalf("expected ErrInvalidIntent, got %v", err)
+	}
+	byRound, err := bob.ScheduleCallForRound(1, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	daily, err := bob.ScheduleCall(2, time.Now().Add(-1*time.Minute), 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later, err := bob.ScheduleCall(0, time.Now().Add(1*time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := alice.nextOutgoingCall(150)
+	if call == nil || call.Username != bob.Username || call.Intent() != 2 {
+		t.Fatalf("expected daily call, got %#v", call)
+	}
+	if _, next := daily.Next(); !next.After(time.Now().Add(23 * time.Hour)) {
+		t.Fatalf("daily call not rescheduled: next=%s", next)
+	}
+	if call := alice.nextOutgoingCall(151); call != nil {
+		t.Fatalf("unexpected call: %#v", call)
+	}
+	call = alice.nextOutgoingCall(200)
+	if call == nil || call.Intent() != 1 {
+		t.Fatalf("expected call for round 200, got %#v", call)
+	}
+	if err := byRound.Cancel(); err != ErrTooLate {
+		t.Fatalf("expected ErrTooLate, got %v", err)
+	}
+	if err := later.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+
+	alice2, err := LoadClient(alice.ClientPersistPath, alice.KeywheelPersistPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := alice2.GetScheduledCalls()
+	if len(calls) != 1 {
+		t.Fatalf("expected 1 scheduled call after reload, got %d", len(calls))
+	}
+	_, want := daily.Next()
+	if _, got := calls[0].Next(); !got.Equal(want) || calls[0].Every != daily.Every || calls[0].Intent != 2 {
+		t.Fatalf("scheduled call changed after reload: next=%s, want %s", got, want)
+	}
+
+	if err := alice2.GetFriend(bob.Username).Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if calls := alice2.GetScheduledCalls(); len(calls) != 0 {
+		t.Fatalf("scheduled calls not removed with friend: %d", len(calls))
+	}
+}
+
+func TestRekey(t *testing.T) {
+	u := createAlpenhornUniverse()
+	defer func() {
+		time.Sleep(1 * time.Second)
+		u.Destroy()
+	}()
+
+	alice := u.newUser("alice@example.org")
+	bob := u.newUser("bob@example.org")
+	for _, c := range []*Client{alice, bob} {
+		if _, err := c.ConnectAddFriend(); err != nil {
+			t.Fatal(err)
+		}
+		defer c.CloseAddFriend()
+		if _, err := c.ConnectDialing(); err != nil {
+			t.Fatal(err)
+		}
+		defer c.CloseDialing()
+	}
+	time.Sleep(2 * time.Second)
+
+	if _, err := alice.SendFriendRequest(bob.Username, nil); err != nil {
+		t.Fatal(err)
+	}
+	<-alice.Handler.(*chanHandler).sentFriendRequest
+	req := <-bob.Handler.(*chanHandler).receivedFriendRequest
+	if _, err := req.Approve(); err != nil {
+		t.Fatal(err)
+	}
+	<-bob.Handler.(*chanHandler).sentFriendRequest
+	aliceFriend := <-alice.Handler.(*chanHandler).confirmedFriend
+	<-bob.Handler.(*chanHandler).confirmedFriend
+
+	if err := aliceFriend.SetExtraData([]byte("notes")); err != nil {
+		t.Fatal(err)
+	}
+	round, _ := aliceFriend.UnsafeKeywheelState()
+	futureRound := round + 1000
+	oldKey := aliceFriend.SessionKey(futureRound)
+
+	if _, err := aliceFriend.Rekey(); err != nil {
+		t.Fatal(err)
+	}
+	<-alice.Handler.(*chanHandler).sentFriendRequest
+	<-bob.Handler.(*chanHandler).sentFriendRequest
+
+	if f := <-alice.Handler.(*chanHandler).rekeyed; f != aliceFriend {
+		t.Fatal("rekeying replaced the Friend object")
+	}
+	bobFriend := <-bob.Handler.(*chanHandler).rekeyed
+	if bobFriend.Username != alice.Username {
+		t.Fatalf("rekeyed unexpected friend: %s", bobFriend.Username)
+	}
+	if reqs := bob.GetIncomingFriendRequests(); len(reqs) != 0 {
+		t.Fatalf("rekey request left in queue: %s", debug.Pretty(reqs))
+	}
+
+	if !bytes.Equal(aliceFriend.ExtraData(), []byte("notes")) {
+		t.Fatalf("extra data changed after rekey: %q", aliceFriend.ExtraData())
+	}
+	newKey := aliceFriend.SessionKey(futureRound)
+	if bytes.Equal(oldKey[:], newKey[:]) {
+		t.Fatal("keywheel secret did not change")
+	}
+	if !bytes.Equal(newKey[:], bobFriend.SessionKey(futureRound)[:]) {
+		t.Fatal("Alice and Bob have different secrets after rekey")
+	}
+
+	aliceFriend.Call(0)
+	outCall := <-alice.Handler.(*chanHandler).sentCall
+	inCall := <-bob.Handler.(*chanHandler).receivedCall
+	if !bytes.Equal(outCall.SessionKey()[:], inCall.SessionKey[:]) {
+		t.Fatal("Alice and Bob agreed on different keys!")
+	}
+}
+
+// testdata/derivekeys.json has test vectors for applications that
+// derive keys from a call's session key without this package.
+func TestPersistRekey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alpenhorn_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	alice := newOfflineClient("alice@example.org")
+	alice.ClientPersistPath = filepath.Join(dir, "alice-client")
+	alice.KeywheelPersistPath = filepath.Join(dir, "alice-keywheel")
+	bobPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	bob := &Friend{
+		Username:    "bob@example.org",
+		LongTermKey: bobPub,
+		client:      alice,
+	}
+	alice.mu.Lock()
+	alice.friends[bob.Username] = bob
+	alice.mu.Unlock()
+	if _, err := bob.Rekey(); err != nil {
+		t.Fatal(err)
+	}
+
+	alice2, err := LoadClient(alice.ClientPersistPath, alice.KeywheelPersistPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := alice2.GetOutgoingFriendRequests()
+	if len(reqs) != 1 || !reqs[0].rekey {
+		t.Fatalf("rekey request not persisted: %#v", reqs)
+	}
+}
+
+func TestFriendRequestFromFriend(t *testing.T) {
+	u := createAlpenhornUniverse()
+	defer func() {
+		time.Sleep(1 * time.Second)
+		u.Destroy()
+	}()
+
+	alice := u.newUser("alice@example.org")
+	bob := u.newUser("bob@example.org")
+	for _, c := range []*Client{alice, bob} {
+		if _, err := c.ConnectAddFriend(); err != nil {
+			t.Fatal(err)
+		}
+		defer c.CloseAddFriend()
+	}
+	time.Sleep(2 * time.Second)
+
+	if _, err := alice.SendFriendRequest(bob.Username, nil); err != nil {
+		t.Fatal(err)
+	}
+	<-alice.Handler.(*chanHandler).sentFriendRequest
+	req := <-bob.Handler.(*chanHandler).receivedFriendRequest
+	if _, err := req.Approve(); err != nil {
+		t.Fatal(err)
+	}
+	<-bob.Handler.(*chanHandler).sentFriendRequest
+	<-alice.Handler.(*chanHandler).confirmedFriend
+	<-bob.Handler.(*chanHandler).confirmedFriend
+
+	// A plain friend request from a friend with the same key is not a
+	// rekey request, so it still goes to the application.
+	if _, err := alice.SendFriendRequest(bob.Username, bob.LongTermPublicKey); err != nil {
+		t.Fatal(err)
+	}
+	<-alice.Handler.(*chanHandler).sentFriendRequest
+	req = <-bob.Handler.(*chanHandler).receivedFriendRequest
+	if req.Username != alice.Username {
+		t.Fatalf("unexpected friend request from %s", req.Username)
+	}
+	if reqs := bob.GetOutgoingFriendRequests(); len(reqs) != 0 {
+		t.Fatalf("friend request was approved automatically: %s", debug.Pretty(reqs))
+	}
+	if reqs := bob.GetIncomingFriendRequests(); len(reqs) != 1 {
+		t.Fatalf("expected 1 incoming request, got %d", len(reqs))
+	}
+}
+
+func TestDeriveKeys(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/derivekeys.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []struct {
+		SessionKey string
+		Caller     string
+		Callee     string
+		Round      uint32
+		Intent     int
+		Label      string
+		Keys       []string
+	}
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, v := range vectors {
+		sessionKey := new([32]byte)
+		if _, err := hex.Decode(sessionKey[:], []byte(v.SessionKey)); err != nil {
+			t.Fatal(err)
+		}
+		keys := deriveKeys(sessionKey, v.Caller, v.Callee, v.Round, v.Intent, v.Label, len(v.Keys))
+		if len(keys) != len(v.Keys) {
+			t.Fatalf("vector %d: got %d keys, want %d", i, len(keys), len(v.Keys))
+		}
+		for j, key := range keys {
+			if got := hex.EncodeToString(key[:]); got != v.Keys[j] {
+				t.Fatalf("vector %d: key %d: got %s, want %s", i, j, got, v.Keys[j])
+			}
+		}
+	}
+
+	for _, n := range []int{-1, maxDerivedKeys + 1} {
+		if keys := deriveKeys(new([32]byte), "alice", "bob", 1, 0, "test", n); keys != nil {
+			t.Fatalf("deriveKeys(n=%d) = %d keys, want nil", n, len(keys))
+		}
+	}
+}
+
+func TestManager(t *testing.T) {
+	u := createAlpenhornUniverse()
+	defer func() {
+		time.Sleep(1 * time.Second)
+		u.Destroy()
+	}()
+
+	alice := u.newUser("alice@example.org")
+	bob := u.newUser("bob@example.org")
+
+	m := &Manager{ConfigClient: u.ConfigClient}
+	if err := m.Add(alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(alice); err == nil {
+		t.Fatal("expected error adding a duplicate client")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- m.Run(ctx)
+	}()
+
+	// Clients added while the manager is running are started right away.
+	if err := m.Add(bob); err != nil {
+		t.Fatal(err)
+	}
+	if cs := m.Clients(); len(cs) != 2 || cs[0] != alice || cs[1] != bob {
+		t.Fatalf("unexpected clients: %v", cs)
+	}
+	if alice.edhttpClient != bob.edhttpClient {
+		t.Fatal("clients do not share an edhttp client")
+	}
+
+	for _, c := range []*Client{alice, bob} {
+		h := c.Handler.(*chanHandler)
+		connected := make(map[string]bool)
+		timeout := time.After(30 * time.Second)
+		for len(connected) < 2 {
+			select {
+			case e := <-h.connectionEvent:
+				if e.State == Connected {
+					connected[e.Service] = true
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for %s to connect", c.Username)
+			}
+		}
+	}
+
+	if _, err := alice.SendFriendRequest(bob.Username, nil); err != nil {
+		t.Fatal(err)
+	}
+	<-alice.Handler.(*chanHandler).sentFriendRequest
+	req := <-bob.Handler.(*chanHandler).receivedFriendRequest
+	if _, err := req.Approve(); err != nil {
+		t.Fatal(err)
+	}
+	<-bob.Handler.(*chanHandler).sentFriendRequest
+	aliceFriend := <-alice.Handler.(*chanHandler).confirmedFriend
+	<-bob.Handler.(*chanHandler).confirmedFriend
+
+	aliceFriend.Call(0)
+	outCall := <-alice.Handler.(*chanHandler).sentCall
+	inCall := <-bob.Handler.(*chanHandler).receivedCall
+	if !bytes.Equal(outCall.SessionKey()[:], inCall.SessionKey[:]) {
+		t.Fatal("Alice and Bob agreed on different keys!")
+	}
+
+	if err := m.Remove(bob.Username); err != nil {
+		t.Fatal(err)
+	}
+	if m.Client(bob.Username) != nil {
+		t.Fatal("removed client is still in the manager")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("unexpected error from Run: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+}
+
+func TestStateStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alpenhorn_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := bolt.Open(filepath.Join(dir, "state.db"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	stores := map[string]StateStore{
+		"file": &FileStore{
+			ClientPath:   filepath.Join(dir, "client"),
+			KeywheelPath: filepath.Join(dir, "keywheel"),
+			CallLogPath:  filepath.Join(dir, "calls"),
+		},
+		"memory": new(MemoryStore),
+		"bolt": &BoltStore{
+			DB:           db,
+			Bucket:       "alice",
+			KeywheelPath: filepath.Join(dir, "bolt-keywheel"),
+		},
+	}
+	for name, store := range stores {
+		if _, err := store.Get(StateClient); !os.IsNotExist(err) {
+			t.Fatalf("%s: Get from empty store: got error %v, want not exist", name, err)
+		}
+
+		alice := newOfflineClient("alice@example.org")
+		alice.Store = store
+		alice.StoreCallLog = true
+		if err := alice.SetPassphrase([]byte("hunter2")); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if err := alice.Block(BlockRule{Username: "eve@example.org"}); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		alice.logCall(CallRecord{
+			Username: "bob@example.org",
+			Round:    7,
+			Time:     time.Unix(time.Now().Unix(), 0).UTC(),
+		})
+		alice.finishDialingRound(&dialingRoundState{Round: 7})
+
+		if _, err := LoadClientFromStore(store); err != ErrEncrypted {
+			t.Fatalf("%s: LoadClientFromStore: got error %v, want %v", name, err, ErrEncrypted)
+		}
+		alice2, err := LoadClientFromStoreWithPassphrase(store, []byte("hunter2"))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if alice2.Store != store {
+			t.Fatalf("%s: loaded client has a different store", name)
+		}
+		alice2.StoreCallLog = true
+		if alice2.Username != alice.Username || !reflect.DeepEqual(alice2.GetBlocked(), alice.GetBlocked()) {
+			t.Fatalf("%s: client state changed after reload", name)
+		}
+		calls, err := alice2.CallHistory()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if len(calls) != 1 || calls[0].Round != 7 {
+			t.Fatalf("%s: unexpected call history: %s", name, debug.Pretty(calls))
+		}
+
+		if err := alice2.ClearCallHistory(); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if _, err := store.Get(StateCallLog); !os.IsNotExist(err) {
+			t.Fatalf("%s: call log still stored: %v", name, err)
+		}
+		if err := alice2.ClearCallHistory(); err != nil {
+			t.Fatalf("%s: clearing twice: %s", name, err)
+		}
+	}
+}
+
+func TestCallLogWrittenEveryRound(t *testing.T) {
+	store := new(MemoryStore)
+	alice := newOfflineClient("alice@example.org")
+	alice.Store = store
+	alice.StoreCallLog = true
+	if err := alice.Persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The log is written in rounds without calls too.
+	alice.finishDialingRound(&dialingRoundState{Round: 1})
+	before, err := store.Get(StateCallLog)
+	if err != nil {
+		t.Fatalf("call log not written in a round without calls: %s", err)
+	}
+
+	// Logging a call doesn't write the log until the round finishes.
+	alice.logCall(CallRecord{Username: "bob@example.org", Round: 2, Time: time.Now()})
+	if data, _ := store.Get(StateCallLog); !bytes.Equal(data, before) {
+		t.Fatal("call log written before the round finished")
+	}
+
+	alice.finishDialingRound(&dialingRoundState{Round: 2})
+	alice2, err := LoadClientFromStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice2.StoreCallLog = true
+	calls, err := alice2.CallHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0].Round != 2 {
+		t.Fatalf("unexpected call history: %s", debug.Pretty(calls))
+	}
+}
+
+func TestBoltStoreKeywheel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alpenhorn_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbPath := filepath.Join(dir, "state.db")
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	noKeywheel := &BoltStore{DB: db, Bucket: "bob"}
+	if err := noKeywheel.Put(StateKeywheel, []byte("keywheel")); err == nil {
+		t.Fatal("BoltStore stored the keywheel without a KeywheelPath")
+	}
+
+	store := &BoltStore{
+		DB:           db,
+		Bucket:       "alice",
+		KeywheelPath: filepath.Join(dir, "keywheel"),
+	}
+	alice := newOfflineClient("alice@example.org")
+	alice.Store = store
+
+	secret := new([32]byte)
+	rand.Read(secret[:])
+	alice.wheel.Put("bob@example.org", 100, secret)
+	if err := alice.Persist(); err != nil {
+		t.Fatal(err)
+	}
+	alice.wheel.EraseKeys(100)
+	if err := alice.persistKeywheel(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{dbPath, store.KeywheelPath} {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, secret[:]) || bytes.Contains(data, []byte(base32.EncodeToString(secret[:]))) {
+			t.Fatalf("erased keywheel secret found in %s", path)
+		}
+	}
+}
+
+func TestStoreCallLogOptIn(t *testing.T) {
+	store := new(MemoryStore)
+	alice := newOfflineClient("alice@example.org")
+	alice.Store = store
+	alice.logCall(CallRecord{Username: "bob@example.org", Round: 7, Time: time.Now()})
+
+	if _, err := store.Get(StateCallLog); !os.IsNotExist(err) {
+		t.Fatalf("call log stored without StoreCallLog: %v", err)
+	}
+	calls, err := alice.CallHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 0 {
+		t.Fatalf("unexpected call history: %s", debug.Pretty(calls))
+	}
+
+	// Clearing the history erases a log kept before it was turned off.
+	if err := store.Put(StateCallLog, []byte("[]")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.ClearCallHistory(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(StateCallLog); !os.IsNotExist(err) {
+		t.Fatalf("call log still stored: %v", err)
+	}
+}
+
+func TestPersistMailboxCursors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alpenhorn_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	alice := newOfflineClient("alice@example.org")
+	alice.ClientPersistPath = filepath.Join(dir, "alice-client")
+	alice.KeywheelPersistPath = filepath.Join(dir, "alice-keywheel")
+	alice.mu.Lock()
+	alice.lastAddFriendMailbox = 12
+	alice.lastDialingMailbox = 345
+	alice.mu.Unlock()
+	if err := alice.Persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	alice2, err := LoadClient(alice.ClientPersistPath, alice.KeywheelPersistPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice2.lastAddFriendMailbox != 12 || alice2.lastDialingMailbox != 345 {
+		t.Fatalf("mailbox cursors not persisted: addfriend=%d dialing=%d", alice2.lastAddFriendMailbox, alice2.lastDialingMailbox)
+	}
+}
+
+func TestTwoCallsPerRound(t *testing.T) {
+	u := createAlpenhornUniverse()
+	defer func() {
+		time.Sleep(1 * time.Second)
+		u.Destroy()
+	}()
+
+	alice := u.newUser("alice@example.org")
+	bob := u.newUser("bob@example.org")
+	for _, c := range []*Client{alice, bob} {
+		if _, err := c.ConnectAddFriend(); err != nil {
+			t.Fatal(err)
+		}
+		defer c.CloseAddFriend()
+		if _, err := c.ConnectDialing(); err != nil {
+			t.Fatal(err)
+		}
+		defer c.CloseDialing()
+	}
+	time.Sleep(2 * time.Second)
+
+	if _, err := alice.SendFriendRequest(bob.Username, nil); err != nil {
+		t.Fatal(err)
+	}
+	<-alice.Handler.(*chanHandler).sentFriendRequest
+	req := <-bob.Handler.(*chanHandler).receivedFriendRequest
+	if _, err := req.Approve(); err != nil {
+		t.Fatal(err)
+	}
+	<-bob.Handler.(*chanHandler).sentFriendRequest
+	aliceFriend := <-alice.Handler.(*chanHandler).confirmedFriend
+	<-bob.Handler.(*chanHandler).confirmedFriend
+
+	aliceFriend.Call(0)
+	aliceFriend.Call(1)
+	out0 := <-alice.Handler.(*chanHandler).sentCall
+	out1 := <-alice.Handler.(*chanHandler).sentCall
+	if out0.sentRound != out1.sentRound {
+		t.Fatalf("calls sent in rounds %d and %d, want one round", out0.sentRound, out1.sentRound)
+	}
+	for _, out := range []*OutgoingCall{out0, out1} {
+		in := <-bob.Handler.(*chanHandler).receivedCall
+		if in.Username != alice.Username || in.Intent != out.Intent() || in.round != out.sentRound {
+			t.Fatalf("received unexpected call: %s intent %d round %d", in.Username, in.Intent, in.round)
+		}
+		if !bytes.Equal(out.SessionKey()[:], in.SessionKey[:]) {
+			t.Fatal("Alice and Bob agreed on different keys!")
+		}
+	}
+}
+
+func TestPersistDegradedMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alpenhorn_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Writes fail until the directory exists.
+	alice := newOfflineClient("alice@example.org")
+	alice.ClientPersistPath = filepath.Join(dir, "missing", "alice-client")
+	alice.KeywheelPersistPath = filepath.Join(dir, "missing", "alice-keywheel")
+
+	err = alice.persistClient()
+	if err == nil {
+		t.Fatal("expected persist to fail")
+	}
+	alice.persistFailed(err)
+	alice.persistFailed(err)
+
+	select {
+	case err := <-alice.Handler.(*chanHandler).errors:
+		if _, ok := err.(*PersistError); !ok {
+			t.Fatalf("expected *PersistError, got %T: %s", err, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for persist error")
+	}
+	select {
+	case err := <-alice.Handler.(*chanHandler).errors:
+		t.Fatalf("persist failure reported twice: %s", err)
+	default:
+	}
+	if !alice.persistDegraded() {
+		t.Fatal("client is not degraded after persist failure")
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "missing"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for alice.persistDegraded() {
+		if time.Now().After(deadline) {
+			t.Fatal("client did not recover after writes started succeeding")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, err := LoadClient(alice.ClientPersistPath, alice.KeywheelPersistPath); err != nil {
+		t.Fatalf("LoadClient after recovery: %s", err)
+	}
+}
+
+// testdata/client-state-vN is a client state written by version N of the
+// persistence format. Loading any version should give the same client.
+func TestLoadClientStateVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alpenhorn_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	current, err := ioutil.ReadFile(fmt.Sprintf("testdata/client-state-v%d", clientStateVersion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ver := 0; ver <= int(clientStateVersion); ver++ {
+		client, err := LoadClient(fmt.Sprintf("testdata/client-state-v%d", ver), "testdata/keywheel")
+		if err != nil {
+			t.Fatalf("version %d: %s", ver, err)
+		}
+
+		if client.Username != "alice@example.org" {
+			t.Fatalf("version %d: unexpected username: %q", ver, client.Username)
+		}
+		friend := client.GetFriend("bob@example.org")
+		if friend == nil {
+			t.Fatalf("version %d: friend not found", ver)
+		}
+		if !bytes.Equal(friend.ExtraData(), []byte("bob's notes")) {
+			t.Fatalf("version %d: unexpected extra data: %q", ver, friend.ExtraData())
+		}
+		if len(client.GetIncomingFriendRequests()) != 1 || len(client.GetSentFriendRequests()) != 1 {
+			t.Fatalf("version %d: missing friend requests", ver)
+		}
+
+		// Persisting the migrated state should give the current format.
+		client.ClientPersistPath = filepath.Join(dir, fmt.Sprintf("client-v%d", ver))
+		client.KeywheelPersistPath = ""
+		if err := client.persistClient(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(client.ClientPersistPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, current) {
+			t.Fatalf("version %d: migrated state does not match version %d:\n%s", ver, clientStateVersion, data)
+		}
+	}
+
+	future := append([]byte{clientStateVersion + 1}, current[1:]...)
+	if _, err := decodeClientState(future); err == nil {
+		t.Fatal("expected error decoding a newer client state version")
+	}
+}
+
 var logger = &log.Logger{
 	Level:        log.InfoLevel,
 	EntryHandler: alplog.OutputText(log.Stderr),
@@ -457,6 +2595,7 @@ type universe struct {
 
 	CoordinatorAddress    string
 	CoordinatorKey        ed25519.PublicKey
+	coordinatorPrivateKey ed25519.PrivateKey
 	dialingServer         *coordinator.Server
 	addFriendServer       *coordinator.Server
 	coordinatorHTTPServer *http.Server
@@ -500,6 +2639,7 @@ func createAlpenhornUniverse() *universe {
 
 	coordinatorPublic, coordinatorPrivate, _ := ed25519.GenerateKey(rand.Reader)
 	u.CoordinatorKey = coordinatorPublic
+	u.coordinatorPrivateKey = coordinatorPrivate
 	coordinatorListener, err := edtls.Listen("tcp", "localhost:0", coordinatorPrivate)
 	if err != nil {
 		log.Panicf("edtls.Listen: %s", err)
@@ -539,6 +2679,10 @@ func createAlpenhornUniverse() *universe {
 				Key:     u.CDN.PublicKey,
 				Address: u.CDN.Addr,
 			},
+			IntrosPerRound: 2,
+			NumMailboxes:   1,
+			PKGWait:        1 * time.Second,
+			MixWait:        1 * time.Second,
 		},
 	}
 	for i, pkgServer := range u.PKGs {
@@ -593,6 +2737,9 @@ func createAlpenhornUniverse() *universe {
 				Key:     u.CDN.PublicKey,
 				Address: u.CDN.Addr,
 			},
+			CallsPerRound: 2,
+			NumMailboxes:  1,
+			MixWait:       1 * time.Second,
 		},
 	}
 	err = u.ConfigServer.SetCurrentConfig(dialingConfig)
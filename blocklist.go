@@ -0,0 +1,135 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"crypto/ed25519"
+	"strings"
+
+	"alpenhorn/errors"
+	"alpenhorn/pkg"
+)
+
+// A BlockRule describes friend requests that the client drops without
+// telling the application. A rule matches a request if every field that
+// is set matches; at least one field must be set.
+//
+//easyjson:readable
+type BlockRule struct {
+	// Username is either a username like "alice@example.org" or a
+	// wildcard domain like "*@spam.example" that matches every
+	// username in the domain.
+	Username string `json:",omitempty"`
+
+	// LongTermKey matches requests signed with this key.
+	LongTermKey ed25519.PublicKey `json:",omitempty"`
+}
+
+func (r BlockRule) validate() error {
+	if r.Username == "" && r.LongTermKey == nil {
+		return errors.New("empty block rule")
+	}
+	if r.LongTermKey != nil && len(r.LongTermKey) != ed25519.PublicKeySize {
+		return errors.New("invalid long-term key: %v", r.LongTermKey)
+	}
+	if strings.HasPrefix(r.Username, "*@") {
+		domain := r.Username[2:]
+		if domain == "" || strings.ContainsAny(domain, "@*") || domain != strings.ToLower(domain) {
+			return errors.New("invalid wildcard domain: %s", r.Username)
+		}
+	} else if r.Username != "" {
+		if err := pkg.ValidateUsername(r.Username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r BlockRule) equal(s BlockRule) bool {
+	return r.Username == s.Username && r.LongTermKey.Equal(s.LongTermKey)
+}
+
+func (r BlockRule) matches(username string, key ed25519.PublicKey) bool {
+	if r.LongTermKey != nil && !r.LongTermKey.Equal(key) {
+		return false
+	}
+	if strings.HasPrefix(r.Username, "*@") {
+		return strings.HasSuffix(username, r.Username[1:])
+	}
+	if r.Username != "" {
+		return username == r.Username
+	}
+	return true
+}
+
+// Block adds a rule to the client's blocklist. Pending incoming friend
+// requests that match the rule are removed.
+func (c *Client) Block(rule BlockRule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, r := range c.blocked {
+		if r.equal(rule) {
+			return nil
+		}
+	}
+	c.blocked = append(c.blocked, rule)
+
+	reqs := c.incomingFriendRequests[:0]
+	for _, req := range c.incomingFriendRequests {
+		if !rule.matches(req.Username, req.LongTermKey) {
+			reqs = append(reqs, req)
+		}
+	}
+	c.incomingFriendRequests = reqs
+
+	return c.persistLocked()
+}
+
+// Unblock removes a rule from the client's blocklist. The rule must
+// be equal to a rule passed to Block.
+func (c *Client) Unblock(rule BlockRule) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	index := -1
+	for i, r := range c.blocked {
+		if r.equal(rule) {
+			index = i
+		}
+	}
+	if index == -1 {
+		return errors.New("not blocked: %+v", rule)
+	}
+
+	c.blocked = append(c.blocked[:index], c.blocked[index+1:]...)
+	return c.persistLocked()
+}
+
+// GetBlocked returns the rules in the client's blocklist.
+func (c *Client) GetBlocked() []BlockRule {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rules := make([]BlockRule, len(c.blocked))
+	copy(rules, c.blocked)
+	return rules
+}
+
+func (c *Client) isBlocked(username string, key ed25519.PublicKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, r := range c.blocked {
+		if r.matches(username, key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"os"
+
+	"github.com/boltdb/bolt"
+
+	"alpenhorn/errors"
+)
+
+// BoltStore is a StateStore that keeps state in a bucket of a bolt
+// database. Clients can share a database by using different buckets.
+//
+// The keywheel is never stored in the database: bolt keeps overwritten
+// values in free pages, so erased keywheel secrets would stay in the
+// database file. BoltStore keeps the keywheel in the file at
+// KeywheelPath instead, and refuses to store it if KeywheelPath is
+// empty. This also lets the database be backed up without the keywheel.
+type BoltStore struct {
+	DB     *bolt.DB
+	Bucket string
+
+	// KeywheelPath is the file where the keywheel is stored. It should
+	// not be backed up; see Client.KeywheelPersistPath.
+	KeywheelPath string
+}
+
+// keywheel returns the store that holds the keywheel.
+func (s *BoltStore) keywheel() (StateStore, error) {
+	if s.KeywheelPath == "" {
+		return nil, errors.New("BoltStore does not store the keywheel in the database; set KeywheelPath")
+	}
+	return &FileStore{KeywheelPath: s.KeywheelPath}, nil
+}
+
+func (s *BoltStore) Get(name string) ([]byte, error) {
+	if name == StateKeywheel {
+		ks, err := s.keywheel()
+		if err != nil {
+			return nil, err
+		}
+		return ks.Get(name)
+	}
+
+	var data []byte
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(s.Bucket))
+		if b == nil {
+			return nil
+		}
+		// The value is only valid during the transaction.
+		if v := b.Get([]byte(name)); v != nil {
+			data = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, &os.PathError{Op: "get", Path: s.Bucket + "/" + name, Err: os.ErrNotExist}
+	}
+	return data, nil
+}
+
+func (s *BoltStore) Put(name string, data []byte) error {
+	if name == StateKeywheel {
+		ks, err := s.keywheel()
+		if err != nil {
+			return err
+		}
+		return ks.Put(name, data)
+	}
+
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(s.Bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), data)
+	})
+}
+
+func (s *BoltStore) Delete(name string) error {
+	if name == StateKeywheel {
+		ks, err := s.keywheel()
+		if err != nil {
+			return err
+		}
+		return ks.Delete(name)
+	}
+
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(s.Bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(name))
+	})
+}
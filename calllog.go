@@ -0,0 +1,154 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"alpenhorn/errors"
+)
+
+// DefaultCallLogSize is the number of calls the client keeps in its
+// call history if CallLogSize is zero.
+const DefaultCallLogSize = 1000
+
+// A CallRecord is an entry in the client's call history.
+type CallRecord struct {
+	Username string
+	Round    uint32
+	Intent   int
+	Outgoing bool
+
+	// Missed is true for incoming calls that the client found while
+	// catching up on rounds that finished when it was disconnected.
+	Missed bool `json:",omitempty"`
+
+	Time time.Time
+}
+
+// CallHistory returns the calls in the client's call history, oldest
+// first. The history is empty unless CallLogPersistPath is set, or
+// StoreCallLog for a client with a Store.
+func (c *Client) CallHistory() ([]CallRecord, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.loadCallLogLocked(); err != nil {
+		return nil, err
+	}
+	calls := make([]CallRecord, len(c.callLog))
+	copy(calls, c.callLog)
+	return calls, nil
+}
+
+// ClearCallHistory erases the client's call history, including the
+// persisted copy. It also erases a copy that was persisted before the
+// call history was turned off.
+func (c *Client) ClearCallHistory() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.callLog = nil
+	c.callLogLoaded = true
+	return c.store().Delete(StateCallLog)
+}
+
+// callLogEnabled reports whether the client keeps a call history.
+func (c *Client) callLogEnabled() bool {
+	if c.Store != nil {
+		return c.StoreCallLog
+	}
+	return c.CallLogPersistPath != ""
+}
+
+// logCall adds a call to the call history. The history is only kept in
+// memory here: finishDialingRound writes it in every round, whether or
+// not there were calls, so the writes don't reveal when the client makes
+// or receives a call. Errors are reported to the handler, since calls
+// are logged from the round handlers.
+func (c *Client) logCall(rec CallRecord) {
+	if err := c.appendCallLog(rec); err != nil {
+		c.Handler.Error(err)
+	}
+}
+
+func (c *Client) appendCallLog(rec CallRecord) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.callLogEnabled() {
+		return nil
+	}
+	if err := c.loadCallLogLocked(); err != nil {
+		return errors.Wrap(err, "loading call log")
+	}
+
+	c.callLog = append(c.callLog, rec)
+	size := c.CallLogSize
+	if size == 0 {
+		size = DefaultCallLogSize
+	}
+	if n := len(c.callLog) - size; n > 0 {
+		c.callLog = append(c.callLog[:0], c.callLog[n:]...)
+	}
+	return nil
+}
+
+// loadCallLogLocked reads the call history the first time it is
+// needed, since CallLogPersistPath is set after the client loads.
+func (c *Client) loadCallLogLocked() error {
+	if c.callLogLoaded || !c.callLogEnabled() {
+		return nil
+	}
+
+	data, err := c.store().Get(StateCallLog)
+	if os.IsNotExist(err) {
+		c.callLogLoaded = true
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var unlock unlocker
+	if c.persistKey != nil {
+		unlock = keyUnlocker(c.persistKey.key)
+	}
+	data, _, err = openFile(data, unlock, c.persistKey != nil)
+	if err != nil {
+		return err
+	}
+
+	var calls []CallRecord
+	if err := json.Unmarshal(data, &calls); err != nil {
+		return errors.Wrap(err, "decoding call log")
+	}
+	c.callLog = calls
+	c.callLogLoaded = true
+	return nil
+}
+
+// persistCallLogLocked writes the call history, encrypted with the same
+// key as the client's other files.
+func (c *Client) persistCallLogLocked() error {
+	if !c.callLogEnabled() {
+		return nil
+	}
+	// Don't overwrite a call log that hasn't been read yet.
+	if err := c.loadCallLogLocked(); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(c.callLog, "", "  ")
+	if err != nil {
+		return err
+	}
+	if c.persistKey != nil {
+		data = c.persistKey.seal(data)
+	}
+
+	return c.store().Put(StateCallLog, data)
+}
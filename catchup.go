@@ -0,0 +1,246 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"alpenhorn/config"
+	"alpenhorn/coordinator"
+	"alpenhorn/errors"
+	"alpenhorn/log"
+)
+
+// catchUpState tracks a catch-up running in the background.
+type catchUpState struct {
+	done chan struct{}
+
+	// scanned is the set of rounds that the catch-up scanned.
+	// It is written before done is closed.
+	scanned map[uint32]bool
+}
+
+// startCatchUp catches up on the service's missed rounds in the
+// background, so the client takes part in live rounds while it
+// fetches the coordinator's history.
+func (c *Client) startCatchUp(service string) {
+	cu := &catchUpState{done: make(chan struct{})}
+	c.mu.Lock()
+	c.catchUps[service] = cu
+	c.mu.Unlock()
+
+	go func() {
+		cu.scanned = c.catchUp(service)
+		close(cu.done)
+	}()
+}
+
+// waitForCatchUp waits for the service's catch-up to finish before the
+// client scans a live round's mailbox, so missed dialing rounds are
+// scanned before newer rounds erase their keys from the keywheel. It
+// reports whether the catch-up already scanned the round.
+func (c *Client) waitForCatchUp(service string, round uint32) bool {
+	c.mu.Lock()
+	cu := c.catchUps[service]
+	c.mu.Unlock()
+	if cu == nil {
+		return false
+	}
+
+	<-cu.done
+	return cu.scanned[round]
+}
+
+// catchUp scans the mailboxes of rounds that finished while the client
+// was disconnected from the service's coordinator, and returns the
+// rounds it scanned.
+//
+// The client only catches up after it has scanned a mailbox from the
+// coordinator; before that, it has no rounds to catch up on.
+func (c *Client) catchUp(service string) map[uint32]bool {
+	c.mu.Lock()
+	var coordinatorConfig config.CoordinatorConfig
+	var lastMailbox uint32
+	switch service {
+	case "AddFriend":
+		coordinatorConfig, lastMailbox = c.addFriendCoordinator, c.lastAddFriendMailbox
+	case "Dialing":
+		coordinatorConfig, lastMailbox = c.dialingCoordinator, c.lastDialingMailbox
+	}
+	c.mu.Unlock()
+
+	if lastMailbox == 0 {
+		return nil
+	}
+
+	history, err := c.fetchHistory(service, coordinatorConfig, lastMailbox)
+	if err != nil {
+		c.Handler.Error(errors.Wrap(err, "fetching %s history", strings.ToLower(service)))
+		return nil
+	}
+	if len(history.Mailboxes) == 0 {
+		return nil
+	}
+	// Mixing can finish out of order, but the keywheel must be scanned in order.
+	sort.Slice(history.Mailboxes, func(i, j int) bool {
+		return history.Mailboxes[i].Round < history.Mailboxes[j].Round
+	})
+	log.Infof("Catching up on %d %s rounds", len(history.Mailboxes), strings.ToLower(service))
+
+	switch service {
+	case "AddFriend":
+		c.catchUpAddFriend(history)
+	case "Dialing":
+		c.catchUpDialing(history)
+	}
+
+	scanned := make(map[uint32]bool, len(history.Mailboxes))
+	for _, mailbox := range history.Mailboxes {
+		scanned[mailbox.Round] = true
+	}
+	return scanned
+}
+
+func (c *Client) fetchHistory(service string, coordinatorConfig config.CoordinatorConfig, since uint32) (*coordinator.History, error) {
+	url := fmt.Sprintf("https://%s/%s/history?since=%d", coordinatorConfig.Address, strings.ToLower(service), since)
+	resp, err := c.edhttpClient.Get(coordinatorConfig.Key, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.New("unsuccessful status code: %s: %q", resp.Status, msg)
+	}
+
+	history := new(coordinator.History)
+	if err := json.NewDecoder(resp.Body).Decode(history); err != nil {
+		return nil, errors.Wrap(err, "decoding history")
+	}
+	return history, nil
+}
+
+// catchUpConfig returns the config that a missed round ran with,
+// according to the coordinator's history. current is the client's config
+// for the service; if the round used a different config, catchUpConfig
+// verifies the chain from current to the round's config.
+func (c *Client) catchUpConfig(current *config.SignedConfig, configHash string) (*config.SignedConfig, error) {
+	if configHash == current.Hash() {
+		return current, nil
+	}
+	if configHash == "" {
+		return nil, errors.New("coordinator did not say which config the round used")
+	}
+	configs, err := c.ConfigClient.FetchAndVerifyChain(current, configHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching config")
+	}
+	return configs[0], nil
+}
+
+// catchUpAddFriendRound returns the state for a missed add-friend round.
+func (c *Client) catchUpAddFriendRound(mailbox coordinator.MailboxURL) (*addFriendRoundState, error) {
+	c.mu.Lock()
+	st, ok := c.addFriendRounds[mailbox.Round]
+	current := c.addFriendConfig
+	c.mu.Unlock()
+	if ok {
+		if st.ConfigParent.Hash() != mailbox.ConfigHash {
+			return nil, errors.New("coordinator announced different configs")
+		}
+		return st, nil
+	}
+
+	// The client missed the round's announcement, so use the config
+	// that the coordinator's history says the round ran with.
+	signed, err := c.catchUpConfig(current, mailbox.ConfigHash)
+	if err != nil {
+		return nil, err
+	}
+	st = &addFriendRoundState{
+		Round:        mailbox.Round,
+		Config:       signed.Inner.(*config.AddFriendConfig),
+		ConfigParent: signed,
+	}
+	c.mu.Lock()
+	c.addFriendRounds[mailbox.Round] = st
+	c.mu.Unlock()
+	return st, nil
+}
+
+func (c *Client) catchUpAddFriend(history *coordinator.History) {
+	pkgRounds := make(map[uint32]*coordinator.PKGRound, len(history.PKGRounds))
+	for _, pkgRound := range history.PKGRounds {
+		pkgRounds[pkgRound.Round] = pkgRound
+	}
+
+	for _, mailbox := range history.Mailboxes {
+		st, err := c.catchUpAddFriendRound(mailbox)
+		if err != nil {
+			c.Handler.Error(errors.Wrap(err, "catching up on add-friend round %d", mailbox.Round))
+			continue
+		}
+
+		// PKGs only keep keys for recent rounds, so this only works
+		// if the client was disconnected briefly.
+		if pkgRound, ok := pkgRounds[mailbox.Round]; ok {
+			c.extractPKGKeys(nil, *pkgRound)
+		}
+
+		st.mu.Lock()
+		extracted := st.ExtractSuccess
+		st.mu.Unlock()
+		if !extracted {
+			log.WithFields(log.Fields{"round": mailbox.Round}).Warn("Can't catch up on add-friend round: no identity keys")
+			continue
+		}
+
+		c.scanMailbox(nil, mailbox)
+	}
+}
+
+// catchUpDialingRound is like catchUpAddFriendRound for dialing rounds.
+func (c *Client) catchUpDialingRound(mailbox coordinator.MailboxURL) error {
+	c.mu.Lock()
+	st, ok := c.dialingRounds[mailbox.Round]
+	current := c.dialingConfig
+	c.mu.Unlock()
+	if ok {
+		if st.ConfigParent.Hash() != mailbox.ConfigHash {
+			return errors.New("coordinator announced different configs")
+		}
+		return nil
+	}
+
+	signed, err := c.catchUpConfig(current, mailbox.ConfigHash)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.dialingRounds[mailbox.Round] = &dialingRoundState{
+		Round:        mailbox.Round,
+		Config:       signed.Inner.(*config.DialingConfig),
+		ConfigParent: signed,
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Client) catchUpDialing(history *coordinator.History) {
+	for _, mailbox := range history.Mailboxes {
+		if err := c.catchUpDialingRound(mailbox); err != nil {
+			c.Handler.Error(errors.Wrap(err, "catching up on dialing round %d", mailbox.Round))
+			continue
+		}
+
+		c.scanBloomFilter(nil, mailbox)
+	}
+}
@@ -6,14 +6,17 @@
 package alpenhorn
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"fmt"
+	"strings"
 	"sync"
 
 	"alpenhorn/config"
 	"alpenhorn/edhttp"
 	"alpenhorn/errors"
 	"alpenhorn/keywheel"
+	"alpenhorn/log"
 	"alpenhorn/pkg"
 	"alpenhorn/typesocket"
 )
@@ -22,7 +25,10 @@ import (
 //go:generate easyjson -output_filename client_json.go .
 
 // An EventHandler specifies how an application should react to
-// events in the Alpenhorn client.
+// events in the Alpenhorn client. The client calls its methods
+// synchronously from its round handlers, so they should return quickly.
+// Applications that would rather receive events on a channel can use
+// an EventStream.
 type EventHandler interface {
 	// Error is called when the Alpenhorn client experiences an error.
 	Error(error)
@@ -42,10 +48,12 @@ type EventHandler interface {
 
 	// UnexpectedSigningKey is called when an incoming friend request corresponds
 	// to a friend request the user sent but has a different long term key than
-	// what the user specified.
+	// what the user specified. The client does not add the friend until the
+	// application calls AcceptUnexpectedKey or RejectUnexpectedKey on the
+	// IncomingFriendRequest.
 	UnexpectedSigningKey(*IncomingFriendRequest, *OutgoingFriendRequest)
 
-	// SendingCall is called when an OutgoingCall is about to be sent to the
+	// SendingCall is called when an OutgoingCall has been sent to the
 	// entry server. The application can finalize the call to get its session key.
 	SendingCall(*OutgoingCall)
 
@@ -58,6 +66,45 @@ type EventHandler interface {
 	NewConfig(chain []*config.SignedConfig)
 }
 
+// A ConnectionStateHandler is an EventHandler that also wants to know
+// about the client's connections. If the client's Handler implements
+// ConnectionStateHandler, Run calls ConnectionStateChanged when the
+// client's connection to the add-friend or dialing coordinator changes
+// state.
+type ConnectionStateHandler interface {
+	ConnectionStateChanged(ConnectionEvent)
+}
+
+// A FriendRequestExpiredHandler is an EventHandler that wants to know
+// when the client drops a pending friend request that outlived the
+// client's FriendRequestLifetime. If the client's Handler implements
+// FriendRequestExpiredHandler, the client calls FriendRequestExpired
+// with exactly one non-nil argument: the incoming request the user did
+// not approve, or the request the user sent that was never confirmed.
+type FriendRequestExpiredHandler interface {
+	FriendRequestExpired(*IncomingFriendRequest, *OutgoingFriendRequest)
+}
+
+// A FriendKeyChangedHandler is an EventHandler that wants to know when
+// the user re-friends someone already in the address book and the
+// friend's long-term key is not the key the client had before. If the
+// client's Handler implements FriendKeyChangedHandler, the client calls
+// FriendKeyChanged before ConfirmedFriend for the friend. The friend is
+// no longer Verified and the users should compare safety numbers again.
+type FriendKeyChangedHandler interface {
+	FriendKeyChanged(friend *Friend, oldKey ed25519.PublicKey)
+}
+
+// A FriendRekeyedHandler is an EventHandler that wants to know when the
+// add-friend protocol is completed with someone who is already a friend
+// with the same long-term key, as with Friend.Rekey. If the client's
+// Handler implements FriendRekeyedHandler, the client calls FriendRekeyed
+// instead of ConfirmedFriend. The friend's keywheel secret has been
+// replaced; the Friend object is unchanged.
+type FriendRekeyedHandler interface {
+	FriendRekeyed(*Friend)
+}
+
 type Client struct {
 	Username           string
 	LongTermPublicKey  ed25519.PublicKey
@@ -83,9 +130,39 @@ type Client struct {
 	// from the client state).
 	KeywheelPersistPath string
 
+	// FriendRequestLifetime limits how long the client keeps pending friend
+	// requests. The zero value keeps them forever. Like KeywheelPersistPath,
+	// it is not persisted.
+	FriendRequestLifetime FriendRequestLifetime
+
+	// CallLogPersistPath is where the client records its call history.
+	// If empty, the client keeps no call history. The call history is
+	// stored apart from the client state so it can be wiped on its own,
+	// and it is written at the end of every dialing round. Like
+	// KeywheelPersistPath, this field is not persisted.
+	CallLogPersistPath string
+
+	// CallLogSize limits the number of calls in the call history.
+	// If zero, the client keeps DefaultCallLogSize calls.
+	CallLogSize int
+
+	// Store, if not nil, is where the client persists its state and
+	// call history instead of the files named by the persist paths.
+	// Like KeywheelPersistPath, it is not persisted.
+	Store StateStore
+
+	// StoreCallLog turns on the call history for a client with a Store.
+	// Without a Store, CallLogPersistPath turns it on instead. Like
+	// KeywheelPersistPath, it is not persisted.
+	StoreCallLog bool
+
 	// wheel is the Alpenhorn keywheel. It is persisted to the KeywheelPersistPath.
 	wheel keywheel.Wheel
 
+	// persistKey, if not nil, is used to encrypt the client state and
+	// keywheel files. It is protected by mu. See SetPassphrase.
+	persistKey *stateKey
+
 	initOnce     sync.Once
 	edhttpClient *edhttp.Client
 
@@ -106,15 +183,56 @@ type Client struct {
 	incomingFriendRequests []*IncomingFriendRequest
 	outgoingFriendRequests []*OutgoingFriendRequest
 	sentFriendRequests     []*sentFriendRequest
+	unexpectedKeys         []*unexpectedKeyMatch
+	blocked                []BlockRule
 	outgoingCalls          []*OutgoingCall
+	scheduledCalls         []*ScheduledCall
+	invites                []issuedInvite
+
+	// callLog is loaded from CallLogPersistPath when it is first used.
+	callLog       []CallRecord
+	callLogLoaded bool
 
 	addFriendConn typesocket.Conn
 	dialingConn   typesocket.Conn
+
+	// addFriendCoordinator and dialingCoordinator are the coordinators
+	// that addFriendConn and dialingConn are connected to.
+	addFriendCoordinator config.CoordinatorConfig
+	dialingCoordinator   config.CoordinatorConfig
+
+	// lastAddFriendMailbox and lastDialingMailbox are the latest rounds
+	// whose mailboxes the client scanned. They are persisted so the client
+	// can catch up after a restart. See catchUp.
+	lastAddFriendMailbox uint32
+	lastDialingMailbox   uint32
+
+	// catchUps maps a service name to the client's latest catch-up
+	// on that service's missed rounds.
+	catchUps map[string]*catchUpState
+
+	// coordinatorMoves maps a service name to the coordinator announced
+	// by a new config that the client has not connected to yet.
+	coordinatorMoves map[string]config.CoordinatorConfig
+
+	// closedConns records the services whose connection was closed by
+	// closeConn, so the client doesn't follow a coordinator move after
+	// the application or Run closed the connection.
+	closedConns map[string]bool
+
+	// persistErr is the last error persisting the client during a round,
+	// or nil if the client's files are up to date. See PersistError.
+	persistErr       error
+	persistRetrying  bool
+	persistRetryStop chan struct{}
 }
 
 func (c *Client) init() {
 	c.initOnce.Do(func() {
-		c.edhttpClient = new(edhttp.Client)
+		// A Manager may have set a shared edhttp client.
+		if c.edhttpClient == nil {
+			c.edhttpClient = new(edhttp.Client)
+		}
 
 		if c.friends == nil {
 			c.friends = make(map[string]*Friend)
@@ -122,6 +240,9 @@ func (c *Client) init() {
 
 		c.addFriendRounds = make(map[uint32]*addFriendRoundState)
 		c.dialingRounds = make(map[uint32]*dialingRoundState)
+		c.coordinatorMoves = make(map[string]config.CoordinatorConfig)
+		c.closedConns = make(map[string]bool)
+		c.catchUps = make(map[string]*catchUpState)
 	})
 }
 
@@ -173,96 +294,219 @@ func (c *Client) PKGStatus() []PKGStatus {
 func (c *Client) ConnectAddFriend() (chan error, error) {
 	c.init()
 
-	if c.ConfigClient == nil {
-		return nil, errors.New("no config client")
+	addFriendConn, err := c.dialCoordinator("AddFriend")
+	if err != nil {
+		return nil, err
 	}
 
-	c.mu.Lock()
-	if c.addFriendConfig == nil {
-		c.mu.Unlock()
-		return nil, errors.New("no addfriend config")
-	}
-	c.mu.Unlock()
+	disconnect := make(chan error, 1)
+	go func() {
+		disconnect <- c.serveCoordinator("AddFriend", addFriendConn)
+	}()
 
-	// Fetch the current config to get the coordinator's key and address.
-	addFriendConfig, err := c.ConfigClient.CurrentConfig("AddFriend")
-	if err != nil {
-		return nil, errors.Wrap(err, "fetching addfriend config")
-	}
-	addFriendInner := addFriendConfig.Inner.(*config.AddFriendConfig)
+	return disconnect, nil
+}
+
+func (c *Client) ConnectDialing() (chan error, error) {
+	c.init()
 
-	afwsAddr := fmt.Sprintf("wss://%s/addfriend/ws", addFriendInner.Coordinator.Address)
-	addFriendConn, err := typesocket.Dial(afwsAddr, addFriendInner.Coordinator.Key)
+	dialingConn, err := c.dialCoordinator("Dialing")
 	if err != nil {
 		return nil, err
 	}
 
-	c.mu.Lock()
-	c.addFriendConn = addFriendConn
-	c.mu.Unlock()
-
 	disconnect := make(chan error, 1)
 	go func() {
-		disconnect <- addFriendConn.Serve(c.addFriendMux())
+		disconnect <- c.serveCoordinator("Dialing", dialingConn)
 	}()
 
 	return disconnect, nil
 }
 
-func (c *Client) ConnectDialing() (chan error, error) {
-	c.init()
-
+// dialCoordinator connects to the coordinator for the given service
+// ("AddFriend" or "Dialing"). It fetches the current config to get the
+// coordinator's key and address.
+func (c *Client) dialCoordinator(service string) (*typesocket.ClientConn, error) {
 	if c.ConfigClient == nil {
 		return nil, errors.New("no config client")
 	}
 
 	c.mu.Lock()
-	if c.dialingConfig == nil {
-		c.mu.Unlock()
-		return nil, errors.New("no dialing config")
+	c.closedConns[service] = false
+	var haveConfig bool
+	switch service {
+	case "AddFriend":
+		haveConfig = c.addFriendConfig != nil
+	case "Dialing":
+		haveConfig = c.dialingConfig != nil
 	}
 	c.mu.Unlock()
+	if !haveConfig {
+		return nil, errors.New("no %s config", strings.ToLower(service))
+	}
 
-	dialingConfig, err := c.ConfigClient.CurrentConfig("Dialing")
+	currentConfig, err := c.ConfigClient.CurrentConfig(service)
 	if err != nil {
-		return nil, errors.Wrap(err, "fetching dialing config")
+		return nil, errors.Wrap(err, "fetching %s config", strings.ToLower(service))
 	}
-	dialingInner := dialingConfig.Inner.(*config.DialingConfig)
 
-	dwsAddr := fmt.Sprintf("wss://%s/dialing/ws", dialingInner.Coordinator.Address)
-	dialingConn, err := typesocket.Dial(dwsAddr, dialingInner.Coordinator.Key)
+	var coordinator config.CoordinatorConfig
+	switch service {
+	case "AddFriend":
+		coordinator = currentConfig.Inner.(*config.AddFriendConfig).Coordinator
+	case "Dialing":
+		coordinator = currentConfig.Inner.(*config.DialingConfig).Coordinator
+	}
+
+	return c.dialCoordinatorAt(service, coordinator)
+}
+
+func (c *Client) dialCoordinatorAt(service string, coordinator config.CoordinatorConfig) (*typesocket.ClientConn, error) {
+	wsAddr := fmt.Sprintf("wss://%s/%s/ws", coordinator.Address, strings.ToLower(service))
+	conn, err := typesocket.Dial(wsAddr, coordinator.Key)
 	if err != nil {
 		return nil, err
 	}
 
 	c.mu.Lock()
-	c.dialingConn = dialingConn
+	if c.closedConns[service] {
+		// closeConn was called while we were dialing.
+		c.mu.Unlock()
+		conn.Close()
+		return nil, errors.New("%s connection closed", strings.ToLower(service))
+	}
+	switch service {
+	case "AddFriend":
+		c.addFriendConn = conn
+		c.addFriendCoordinator = coordinator
+	case "Dialing":
+		c.dialingConn = conn
+		c.dialingCoordinator = coordinator
+	}
+	delete(c.coordinatorMoves, service)
 	c.mu.Unlock()
 
-	disconnect := make(chan error, 1)
-	go func() {
-		disconnect <- dialingConn.Serve(c.dialingMux())
-	}()
+	return conn, nil
+}
 
-	return disconnect, nil
+// serveCoordinator serves conn until the connection is lost. If the
+// connection was closed because a new config moved the service to a
+// different coordinator, serveCoordinator dials the new coordinator
+// and serves that connection instead.
+func (c *Client) serveCoordinator(service string, conn *typesocket.ClientConn) error {
+	var mux typesocket.Mux
+	switch service {
+	case "AddFriend":
+		mux = c.addFriendMux()
+	case "Dialing":
+		mux = c.dialingMux()
+	}
+
+	for {
+		c.startCatchUp(service)
+		err := conn.Serve(mux)
+
+		c.mu.Lock()
+		coordinator, moved := c.coordinatorMoves[service]
+		closed := c.closedConns[service]
+		c.mu.Unlock()
+		if !moved || closed {
+			return err
+		}
+
+		log.Infof("Following %s coordinator to %s", service, coordinator.Address)
+		conn, err = c.dialCoordinatorAt(service, coordinator)
+		if err != nil {
+			return errors.Wrap(err, "dialing new %s coordinator", strings.ToLower(service))
+		}
+	}
 }
 
-func (c *Client) CloseAddFriend() error {
+// followCoordinatorLocked is called when the client accepts a new config
+// for service, assuming c.mu is locked. If the config moves the service to
+// a different coordinator, it closes the current connection and records
+// the new coordinator so serveCoordinator can dial it. Queued friend requests
+// and calls are not affected and will be sent to the new coordinator.
+func (c *Client) followCoordinatorLocked(service string, coordinator config.CoordinatorConfig) {
+	var conn typesocket.Conn
+	var current config.CoordinatorConfig
+	switch service {
+	case "AddFriend":
+		conn, current = c.addFriendConn, c.addFriendCoordinator
+	case "Dialing":
+		conn, current = c.dialingConn, c.dialingCoordinator
+	}
+	if conn == nil || sameCoordinator(current, coordinator) {
+		return
+	}
+
+	c.coordinatorMoves[service] = coordinator
+
+	// Round numbers are chosen by the coordinator, so state from the
+	// old coordinator's rounds must not be mixed with the new one's.
+	switch service {
+	case "AddFriend":
+		c.lastAddFriendMailbox = 0
+		old := make([]*addFriendRoundState, 0, len(c.addFriendRounds))
+		for _, st := range c.addFriendRounds {
+			old = append(old, st)
+		}
+		// Round locks can't be taken while c.mu is locked.
+		go eraseAddFriendRounds(old)
+		c.addFriendRounds = make(map[uint32]*addFriendRoundState)
+	case "Dialing":
+		c.lastDialingMailbox = 0
+		c.dialingRounds = make(map[uint32]*dialingRoundState)
+	}
+
+	// Don't block round handlers on the network.
+	go conn.Close()
+}
+
+func sameCoordinator(a, b config.CoordinatorConfig) bool {
+	return a.Address == b.Address && bytes.Equal(a.Key, b.Key)
+}
+
+// isCurrentConn reports whether conn is the client's current connection
+// for service. Messages from an old coordinator are ignored.
+func (c *Client) isCurrentConn(service string, conn typesocket.Conn) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-
-	if c.addFriendConn != nil {
-		return c.addFriendConn.Close()
+	switch service {
+	case "AddFriend":
+		return c.addFriendConn == conn
+	case "Dialing":
+		return c.dialingConn == conn
 	}
-	return nil
+	return false
+}
+
+func (c *Client) CloseAddFriend() error {
+	return c.closeConn("AddFriend")
 }
 
 func (c *Client) CloseDialing() error {
+	return c.closeConn("Dialing")
+}
+
+func (c *Client) closeConn(service string) error {
+	c.init()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.dialingConn != nil {
-		return c.dialingConn.Close()
+	c.closedConns[service] = true
+	delete(c.coordinatorMoves, service)
+
+	var conn typesocket.Conn
+	switch service {
+	case "AddFriend":
+		conn = c.addFriendConn
+	case "Dialing":
+		conn = c.dialingConn
+	}
+	if conn != nil {
+		return conn.Close()
 	}
 	return nil
 }
@@ -9,6 +9,7 @@ import (
 	jwriter "github.com/davidlazar/easyjson/jwriter"
 	config "alpenhorn/config"
 	pkg "alpenhorn/pkg"
+	time "time"
 )
 
 // suppress unused package warning
@@ -19,6 +20,105 @@ var (
 	_ easyjson.Marshaler
 )
 
+func easyjsonDecodeUnexpectedKeyMatchC2eed687(in *jlexer.Lexer, out *unexpectedKeyMatch) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "Incoming":
+			if in.IsNull() {
+				in.Skip()
+				out.Incoming = nil
+			} else {
+				if out.Incoming == nil {
+					out.Incoming = new(IncomingFriendRequest)
+				}
+				(*out.Incoming).UnmarshalEasyJSON(in)
+			}
+		case "Sent":
+			if in.IsNull() {
+				in.Skip()
+				out.Sent = nil
+			} else {
+				if out.Sent == nil {
+					out.Sent = new(sentFriendRequest)
+				}
+				(*out.Sent).UnmarshalEasyJSON(in)
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonEncodeUnexpectedKeyMatchC2eed687(out *jwriter.Writer, in unexpectedKeyMatch) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Incoming\":")
+	if in.Incoming == nil {
+		out.RawString("null")
+	} else {
+		(*in.Incoming).MarshalEasyJSON(out)
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Sent\":")
+	if in.Sent == nil {
+		out.RawString("null")
+	} else {
+		(*in.Sent).MarshalEasyJSON(out)
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v unexpectedKeyMatch) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonEncodeUnexpectedKeyMatchC2eed687(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v unexpectedKeyMatch) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonEncodeUnexpectedKeyMatchC2eed687(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *unexpectedKeyMatch) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonDecodeUnexpectedKeyMatchC2eed687(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *unexpectedKeyMatch) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonDecodeUnexpectedKeyMatchC2eed687(l, v)
+}
 func easyjsonDecodeSentFriendRequestC2eed687(in *jlexer.Lexer, out *sentFriendRequest) {
 	isTopLevel := in.IsStart()
 	if in.IsNull() {
@@ -53,6 +153,10 @@ func easyjsonDecodeSentFriendRequestC2eed687(in *jlexer.Lexer, out *sentFriendRe
 			out.DialRound = uint32(in.Uint32())
 		case "SentRound":
 			out.SentRound = uint32(in.Uint32())
+		case "SentTime":
+			if data := in.Raw(); in.Ok() {
+				in.AddError((out.SentTime).UnmarshalJSON(data))
+			}
 		case "DHPublicKey":
 			if in.IsNull() {
 				in.Skip()
@@ -81,6 +185,10 @@ func easyjsonDecodeSentFriendRequestC2eed687(in *jlexer.Lexer, out *sentFriendRe
 					copy((*out.DHPrivateKey)[:], in.BytesReadable())
 				}
 			}
+		case "Verified":
+			out.Verified = bool(in.Bool())
+		case "Rekey":
+			out.Rekey = bool(in.Bool())
 		default:
 			in.SkipRecursive()
 		}
@@ -129,6 +237,12 @@ func easyjsonEncodeSentFriendRequestC2eed687(out *jwriter.Writer, in sentFriendR
 		out.RawByte(',')
 	}
 	first = false
+	out.RawString("\"SentTime\":")
+	out.Raw((in.SentTime).MarshalJSON())
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
 	out.RawString("\"DHPublicKey\":")
 	if in.DHPublicKey == nil {
 		out.RawString("null")
@@ -145,6 +259,22 @@ func easyjsonEncodeSentFriendRequestC2eed687(out *jwriter.Writer, in sentFriendR
 	} else {
 		out.Base32Bytes((*in.DHPrivateKey)[:])
 	}
+	if in.Verified {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"Verified\":")
+		out.Bool(bool(in.Verified))
+	}
+	if in.Rekey {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"Rekey\":")
+		out.Bool(bool(in.Rekey))
+	}
 	out.RawByte('}')
 }
 
@@ -276,21 +406,21 @@ func easyjsonDecodePersistedStateC2eed687(in *jlexer.Lexer, out *persistedState)
 				in.Delim('[')
 				if out.OutgoingFriendRequests == nil {
 					if !in.IsDelim(']') {
-						out.OutgoingFriendRequests = make([]*OutgoingFriendRequest, 0, 8)
+						out.OutgoingFriendRequests = make([]*persistedOutgoingFriendRequest, 0, 8)
 					} else {
-						out.OutgoingFriendRequests = []*OutgoingFriendRequest{}
+						out.OutgoingFriendRequests = []*persistedOutgoingFriendRequest{}
 					}
 				} else {
 					out.OutgoingFriendRequests = (out.OutgoingFriendRequests)[:0]
 				}
 				for !in.IsDelim(']') {
-					var v12 *OutgoingFriendRequest
+					var v12 *persistedOutgoingFriendRequest
 					if in.IsNull() {
 						in.Skip()
 						v12 = nil
 					} else {
 						if v12 == nil {
-							v12 = new(OutgoingFriendRequest)
+							v12 = new(persistedOutgoingFriendRequest)
 						}
 						(*v12).UnmarshalEasyJSON(in)
 					}
@@ -330,6 +460,37 @@ func easyjsonDecodePersistedStateC2eed687(in *jlexer.Lexer, out *persistedState)
 				}
 				in.Delim(']')
 			}
+		case "UnexpectedKeys":
+			if in.IsNull() {
+				in.Skip()
+				out.UnexpectedKeys = nil
+			} else {
+				in.Delim('[')
+				if out.UnexpectedKeys == nil {
+					if !in.IsDelim(']') {
+						out.UnexpectedKeys = make([]*unexpectedKeyMatch, 0, 8)
+					} else {
+						out.UnexpectedKeys = []*unexpectedKeyMatch{}
+					}
+				} else {
+					out.UnexpectedKeys = (out.UnexpectedKeys)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v14 *unexpectedKeyMatch
+					if in.IsNull() {
+						in.Skip()
+						v14 = nil
+					} else {
+						if v14 == nil {
+							v14 = new(unexpectedKeyMatch)
+						}
+						(*v14).UnmarshalEasyJSON(in)
+					}
+					out.UnexpectedKeys = append(out.UnexpectedKeys, v14)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
 		case "Friends":
 			if in.IsNull() {
 				in.Skip()
@@ -343,21 +504,94 @@ func easyjsonDecodePersistedStateC2eed687(in *jlexer.Lexer, out *persistedState)
 				for !in.IsDelim('}') {
 					key := string(in.String())
 					in.WantColon()
-					var v14 *persistedFriend
+					var v15 *persistedFriend
 					if in.IsNull() {
 						in.Skip()
-						v14 = nil
+						v15 = nil
 					} else {
-						if v14 == nil {
-							v14 = new(persistedFriend)
+						if v15 == nil {
+							v15 = new(persistedFriend)
 						}
-						(*v14).UnmarshalEasyJSON(in)
+						(*v15).UnmarshalEasyJSON(in)
 					}
-					(out.Friends)[key] = v14
+					(out.Friends)[key] = v15
 					in.WantComma()
 				}
 				in.Delim('}')
 			}
+		case "Blocked":
+			if in.IsNull() {
+				in.Skip()
+				out.Blocked = nil
+			} else {
+				in.Delim('[')
+				if out.Blocked == nil {
+					if !in.IsDelim(']') {
+						out.Blocked = make([]BlockRule, 0, 1)
+					} else {
+						out.Blocked = []BlockRule{}
+					}
+				} else {
+					out.Blocked = (out.Blocked)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v16 BlockRule
+					(v16).UnmarshalEasyJSON(in)
+					out.Blocked = append(out.Blocked, v16)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "ScheduledCalls":
+			if in.IsNull() {
+				in.Skip()
+				out.ScheduledCalls = nil
+			} else {
+				in.Delim('[')
+				if out.ScheduledCalls == nil {
+					if !in.IsDelim(']') {
+						out.ScheduledCalls = make([]persistedScheduledCall, 0, 1)
+					} else {
+						out.ScheduledCalls = []persistedScheduledCall{}
+					}
+				} else {
+					out.ScheduledCalls = (out.ScheduledCalls)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v17 persistedScheduledCall
+					(v17).UnmarshalEasyJSON(in)
+					out.ScheduledCalls = append(out.ScheduledCalls, v17)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "Invites":
+			if in.IsNull() {
+				in.Skip()
+				out.Invites = nil
+			} else {
+				in.Delim('[')
+				if out.Invites == nil {
+					if !in.IsDelim(']') {
+						out.Invites = make([]issuedInvite, 0, 1)
+					} else {
+						out.Invites = []issuedInvite{}
+					}
+				} else {
+					out.Invites = (out.Invites)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v18 issuedInvite
+					(v18).UnmarshalEasyJSON(in)
+					out.Invites = append(out.Invites, v18)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "LastAddFriendMailbox":
+			out.LastAddFriendMailbox = uint32(in.Uint32())
+		case "LastDialingMailbox":
+			out.LastDialingMailbox = uint32(in.Uint32())
 		default:
 			in.SkipRecursive()
 		}
@@ -425,14 +659,14 @@ func easyjsonEncodePersistedStateC2eed687(out *jwriter.Writer, in persistedState
 		out.RawString("null")
 	} else {
 		out.RawByte('[')
-		for v21, v22 := range in.IncomingFriendRequests {
-			if v21 > 0 {
+		for v25, v26 := range in.IncomingFriendRequests {
+			if v25 > 0 {
 				out.RawByte(',')
 			}
-			if v22 == nil {
+			if v26 == nil {
 				out.RawString("null")
 			} else {
-				(*v22).MarshalEasyJSON(out)
+				(*v26).MarshalEasyJSON(out)
 			}
 		}
 		out.RawByte(']')
@@ -446,14 +680,14 @@ func easyjsonEncodePersistedStateC2eed687(out *jwriter.Writer, in persistedState
 		out.RawString("null")
 	} else {
 		out.RawByte('[')
-		for v23, v24 := range in.OutgoingFriendRequests {
-			if v23 > 0 {
+		for v27, v28 := range in.OutgoingFriendRequests {
+			if v27 > 0 {
 				out.RawByte(',')
 			}
-			if v24 == nil {
+			if v28 == nil {
 				out.RawString("null")
 			} else {
-				(*v24).MarshalEasyJSON(out)
+				(*v28).MarshalEasyJSON(out)
 			}
 		}
 		out.RawByte(']')
@@ -467,18 +701,41 @@ func easyjsonEncodePersistedStateC2eed687(out *jwriter.Writer, in persistedState
 		out.RawString("null")
 	} else {
 		out.RawByte('[')
-		for v25, v26 := range in.SentFriendRequests {
-			if v25 > 0 {
+		for v29, v30 := range in.SentFriendRequests {
+			if v29 > 0 {
 				out.RawByte(',')
 			}
-			if v26 == nil {
+			if v30 == nil {
 				out.RawString("null")
 			} else {
-				(*v26).MarshalEasyJSON(out)
+				(*v30).MarshalEasyJSON(out)
 			}
 		}
 		out.RawByte(']')
 	}
+	if len(in.UnexpectedKeys) != 0 {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"UnexpectedKeys\":")
+		if in.UnexpectedKeys == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+			out.RawString("null")
+		} else {
+			out.RawByte('[')
+			for v31, v32 := range in.UnexpectedKeys {
+				if v31 > 0 {
+					out.RawByte(',')
+				}
+				if v32 == nil {
+					out.RawString("null")
+				} else {
+					(*v32).MarshalEasyJSON(out)
+				}
+			}
+			out.RawByte(']')
+		}
+	}
 	if !first {
 		out.RawByte(',')
 	}
@@ -488,22 +745,95 @@ func easyjsonEncodePersistedStateC2eed687(out *jwriter.Writer, in persistedState
 		out.RawString(`null`)
 	} else {
 		out.RawByte('{')
-		v27First := true
-		for v27Name, v27Value := range in.Friends {
-			if !v27First {
+		v33First := true
+		for v33Name, v33Value := range in.Friends {
+			if !v33First {
 				out.RawByte(',')
 			}
-			v27First = false
-			out.String(string(v27Name))
+			v33First = false
+			out.String(string(v33Name))
 			out.RawByte(':')
-			if v27Value == nil {
+			if v33Value == nil {
 				out.RawString("null")
 			} else {
-				(*v27Value).MarshalEasyJSON(out)
+				(*v33Value).MarshalEasyJSON(out)
 			}
 		}
 		out.RawByte('}')
 	}
+	if len(in.Blocked) != 0 {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"Blocked\":")
+		if in.Blocked == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+			out.RawString("null")
+		} else {
+			out.RawByte('[')
+			for v34, v35 := range in.Blocked {
+				if v34 > 0 {
+					out.RawByte(',')
+				}
+				(v35).MarshalEasyJSON(out)
+			}
+			out.RawByte(']')
+		}
+	}
+	if len(in.ScheduledCalls) != 0 {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"ScheduledCalls\":")
+		if in.ScheduledCalls == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+			out.RawString("null")
+		} else {
+			out.RawByte('[')
+			for v36, v37 := range in.ScheduledCalls {
+				if v36 > 0 {
+					out.RawByte(',')
+				}
+				(v37).MarshalEasyJSON(out)
+			}
+			out.RawByte(']')
+		}
+	}
+	if len(in.Invites) != 0 {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"Invites\":")
+		if in.Invites == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+			out.RawString("null")
+		} else {
+			out.RawByte('[')
+			for v38, v39 := range in.Invites {
+				if v38 > 0 {
+					out.RawByte(',')
+				}
+				(v39).MarshalEasyJSON(out)
+			}
+			out.RawByte(']')
+		}
+	}
+	if in.LastAddFriendMailbox != 0 {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"LastAddFriendMailbox\":")
+		out.Uint32(uint32(in.LastAddFriendMailbox))
+	}
+	if in.LastDialingMailbox != 0 {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"LastDialingMailbox\":")
+		out.Uint32(uint32(in.LastDialingMailbox))
+	}
 	out.RawByte('}')
 }
 
@@ -530,6 +860,242 @@ func (v *persistedState) UnmarshalJSON(data []byte) error {
 func (v *persistedState) UnmarshalEasyJSON(l *jlexer.Lexer) {
 	easyjsonDecodePersistedStateC2eed687(l, v)
 }
+func easyjsonDecodePersistedScheduledCallC2eed687(in *jlexer.Lexer, out *persistedScheduledCall) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "Username":
+			out.Username = string(in.String())
+		case "Intent":
+			out.Intent = int(in.Int())
+		case "Every":
+			out.Every = time.Duration(in.Int64())
+		case "Round":
+			out.Round = uint32(in.Uint32())
+		case "Next":
+			if data := in.Raw(); in.Ok() {
+				in.AddError((out.Next).UnmarshalJSON(data))
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonEncodePersistedScheduledCallC2eed687(out *jwriter.Writer, in persistedScheduledCall) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Username\":")
+	out.String(string(in.Username))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Intent\":")
+	out.Int(int(in.Intent))
+	if in.Every != 0 {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"Every\":")
+		out.Int64(int64(in.Every))
+	}
+	if in.Round != 0 {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"Round\":")
+		out.Uint32(uint32(in.Round))
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Next\":")
+	out.Raw((in.Next).MarshalJSON())
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v persistedScheduledCall) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonEncodePersistedScheduledCallC2eed687(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v persistedScheduledCall) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonEncodePersistedScheduledCallC2eed687(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *persistedScheduledCall) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonDecodePersistedScheduledCallC2eed687(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *persistedScheduledCall) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonDecodePersistedScheduledCallC2eed687(l, v)
+}
+func easyjsonDecodePersistedOutgoingFriendRequestC2eed687(in *jlexer.Lexer, out *persistedOutgoingFriendRequest) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "Username":
+			out.Username = string(in.String())
+		case "ExpectedKey":
+			if in.IsNull() {
+				in.Skip()
+				out.ExpectedKey = nil
+			} else {
+				out.ExpectedKey = in.BytesReadable()
+			}
+		case "Confirmation":
+			out.Confirmation = bool(in.Bool())
+		case "DialRound":
+			out.DialRound = uint32(in.Uint32())
+		case "Verified":
+			out.Verified = bool(in.Bool())
+		case "InviteSecret":
+			if in.IsNull() {
+				in.Skip()
+				out.InviteSecret = nil
+			} else {
+				out.InviteSecret = in.BytesReadable()
+			}
+		case "Rekey":
+			out.Rekey = bool(in.Bool())
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonEncodePersistedOutgoingFriendRequestC2eed687(out *jwriter.Writer, in persistedOutgoingFriendRequest) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Username\":")
+	out.String(string(in.Username))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"ExpectedKey\":")
+	out.Base32Bytes(in.ExpectedKey)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Confirmation\":")
+	out.Bool(bool(in.Confirmation))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"DialRound\":")
+	out.Uint32(uint32(in.DialRound))
+	if in.Verified {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"Verified\":")
+		out.Bool(bool(in.Verified))
+	}
+	if len(in.InviteSecret) != 0 {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"InviteSecret\":")
+		out.Base32Bytes(in.InviteSecret)
+	}
+	if in.Rekey {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"Rekey\":")
+		out.Bool(bool(in.Rekey))
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v persistedOutgoingFriendRequest) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonEncodePersistedOutgoingFriendRequestC2eed687(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v persistedOutgoingFriendRequest) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonEncodePersistedOutgoingFriendRequestC2eed687(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *persistedOutgoingFriendRequest) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonDecodePersistedOutgoingFriendRequestC2eed687(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *persistedOutgoingFriendRequest) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonDecodePersistedOutgoingFriendRequestC2eed687(l, v)
+}
 func easyjsonDecodePersistedFriendC2eed687(in *jlexer.Lexer, out *persistedFriend) {
 	isTopLevel := in.IsStart()
 	if in.IsNull() {
@@ -565,6 +1131,8 @@ func easyjsonDecodePersistedFriendC2eed687(in *jlexer.Lexer, out *persistedFrien
 			} else {
 				out.ExtraData = in.BytesReadable()
 			}
+		case "Verified":
+			out.Verified = bool(in.Bool())
 		default:
 			in.SkipRecursive()
 		}
@@ -597,6 +1165,14 @@ func easyjsonEncodePersistedFriendC2eed687(out *jwriter.Writer, in persistedFrie
 	first = false
 	out.RawString("\"ExtraData\":")
 	out.Base32Bytes(in.ExtraData)
+	if in.Verified {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"Verified\":")
+		out.Bool(bool(in.Verified))
+	}
 	out.RawByte('}')
 }
 
@@ -623,6 +1199,88 @@ func (v *persistedFriend) UnmarshalJSON(data []byte) error {
 func (v *persistedFriend) UnmarshalEasyJSON(l *jlexer.Lexer) {
 	easyjsonDecodePersistedFriendC2eed687(l, v)
 }
+func easyjsonDecodeIssuedInviteC2eed687(in *jlexer.Lexer, out *issuedInvite) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "Secret":
+			if in.IsNull() {
+				in.Skip()
+				out.Secret = nil
+			} else {
+				out.Secret = in.BytesReadable()
+			}
+		case "Expires":
+			if data := in.Raw(); in.Ok() {
+				in.AddError((out.Expires).UnmarshalJSON(data))
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonEncodeIssuedInviteC2eed687(out *jwriter.Writer, in issuedInvite) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Secret\":")
+	out.Base32Bytes(in.Secret)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Expires\":")
+	out.Raw((in.Expires).MarshalJSON())
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v issuedInvite) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonEncodeIssuedInviteC2eed687(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v issuedInvite) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonEncodeIssuedInviteC2eed687(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *issuedInvite) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonDecodeIssuedInviteC2eed687(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *issuedInvite) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonDecodeIssuedInviteC2eed687(l, v)
+}
 func easyjsonDecodeOutgoingFriendRequestC2eed687(in *jlexer.Lexer, out *OutgoingFriendRequest) {
 	isTopLevel := in.IsStart()
 	if in.IsNull() {
@@ -779,13 +1437,19 @@ func easyjsonDecodeIncomingFriendRequestC2eed687(in *jlexer.Lexer, out *Incoming
 					out.Verifiers = (out.Verifiers)[:0]
 				}
 				for !in.IsDelim(']') {
-					var v39 pkg.PublicServerConfig
-					(v39).UnmarshalEasyJSON(in)
-					out.Verifiers = append(out.Verifiers, v39)
+					var v60 pkg.PublicServerConfig
+					(v60).UnmarshalEasyJSON(in)
+					out.Verifiers = append(out.Verifiers, v60)
 					in.WantComma()
 				}
 				in.Delim(']')
 			}
+		case "ReceivedRound":
+			out.ReceivedRound = uint32(in.Uint32())
+		case "ReceivedTime":
+			if data := in.Raw(); in.Ok() {
+				in.AddError((out.ReceivedTime).UnmarshalJSON(data))
+			}
 		default:
 			in.SkipRecursive()
 		}
@@ -837,14 +1501,26 @@ func easyjsonEncodeIncomingFriendRequestC2eed687(out *jwriter.Writer, in Incomin
 		out.RawString("null")
 	} else {
 		out.RawByte('[')
-		for v43, v44 := range in.Verifiers {
-			if v43 > 0 {
+		for v64, v65 := range in.Verifiers {
+			if v64 > 0 {
 				out.RawByte(',')
 			}
-			(v44).MarshalEasyJSON(out)
+			(v65).MarshalEasyJSON(out)
 		}
 		out.RawByte(']')
 	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"ReceivedRound\":")
+	out.Uint32(uint32(in.ReceivedRound))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"ReceivedTime\":")
+	out.Raw((in.ReceivedTime).MarshalJSON())
 	out.RawByte('}')
 }
 
@@ -871,3 +1547,87 @@ func (v *IncomingFriendRequest) UnmarshalJSON(data []byte) error {
 func (v *IncomingFriendRequest) UnmarshalEasyJSON(l *jlexer.Lexer) {
 	easyjsonDecodeIncomingFriendRequestC2eed687(l, v)
 }
+func easyjsonDecodeBlockRuleC2eed687(in *jlexer.Lexer, out *BlockRule) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "Username":
+			out.Username = string(in.String())
+		case "LongTermKey":
+			if in.IsNull() {
+				in.Skip()
+				out.LongTermKey = nil
+			} else {
+				out.LongTermKey = in.BytesReadable()
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonEncodeBlockRuleC2eed687(out *jwriter.Writer, in BlockRule) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if in.Username != "" {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"Username\":")
+		out.String(string(in.Username))
+	}
+	if len(in.LongTermKey) != 0 {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"LongTermKey\":")
+		out.Base32Bytes(in.LongTermKey)
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v BlockRule) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonEncodeBlockRuleC2eed687(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v BlockRule) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonEncodeBlockRuleC2eed687(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *BlockRule) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonDecodeBlockRuleC2eed687(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *BlockRule) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonDecodeBlockRuleC2eed687(l, v)
+}
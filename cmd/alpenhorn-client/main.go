@@ -0,0 +1,433 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Command alpenhorn-client is a headless Alpenhorn client for testing
+// deployments. Run it without arguments for usage.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"alpenhorn"
+	"alpenhorn/config"
+	"alpenhorn/errors"
+	"alpenhorn/log"
+
+	"vuvuzela.io/crypto/rand"
+)
+
+var (
+	persistPath     = flag.String("persist", "persist_client", "persistent data directory")
+	configServerURL = flag.String("config-server", config.StdClient.ConfigServerURL, "config server URL")
+	callTimeout     = flag.Duration("timeout", 2*time.Minute, "how long the call command waits for a dialing round")
+	usePassphrase   = flag.Bool("passphrase", false, "prompt for a passphrase that encrypts the persistent data")
+)
+
+const usage = `Usage: alpenhorn-client [flags] <command> [args]
+
+Setup commands:
+  init <username>          generate keys and fetch the current configs
+  register <token>         register with every PKG in the add-friend config
+  bootstrap                replace the client's configs with the current configs
+  repl                     connect and read commands from stdin, printing events
+
+Client commands (also available in the REPL):
+  whoami                   print the username and long-term key
+  add <username> [key]     send a friend request, optionally pinned to a key
+  requests                 list pending friend requests
+  approve <username>       approve an incoming friend request
+  reject <username>        reject an incoming friend request
+  friends                  list friends
+  call <username> <intent> call a friend
+
+Outside the REPL, call connects and waits until the call is sent.
+Friend requests are sent the next time the client connects.
+
+Flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "init":
+		if len(args) != 2 {
+			log.Fatal("usage: init <username>")
+		}
+		doInit(args[1])
+	case "register":
+		if len(args) != 2 {
+			log.Fatal("usage: register <token>")
+		}
+		doRegister(args[1])
+	case "bootstrap":
+		client := loadClient()
+		if err := bootstrap(client); err != nil {
+			log.Fatal(err)
+		}
+		if err := client.Persist(); err != nil {
+			log.Fatal(err)
+		}
+	case "repl":
+		doREPL()
+	case "call":
+		doCall(args[1:])
+	default:
+		client := loadClient()
+		if err := runCommand(client, args); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func clientPaths() (clientPath, keywheelPath, callLogPath string) {
+	return filepath.Join(*persistPath, "client"),
+		filepath.Join(*persistPath, "keywheel"),
+		filepath.Join(*persistPath, "calls")
+}
+
+func doInit(username string) {
+	if err := os.MkdirAll(*persistPath, 0700); err != nil {
+		log.Fatal(err)
+	}
+	clientPath, keywheelPath, _ := clientPaths()
+	if _, err := os.Stat(clientPath); err == nil {
+		log.Fatalf("%s already exists", clientPath)
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := &alpenhorn.Client{
+		Username:           username,
+		LongTermPublicKey:  publicKey,
+		LongTermPrivateKey: privateKey,
+		PKGLoginKey:        privateKey,
+
+		ConfigClient: &config.Client{ConfigServerURL: *configServerURL},
+
+		ClientPersistPath:   clientPath,
+		KeywheelPersistPath: keywheelPath,
+	}
+	if err := bootstrap(client); err != nil {
+		log.Fatal(err)
+	}
+	if *usePassphrase {
+		err = client.SetPassphrase(readPassphrase())
+	} else {
+		err = client.Persist()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Wrote %s\n", clientPath)
+	fmt.Printf("Username: %s\n", username)
+	fmt.Printf("Key: %s\n", base32.EncodeToString(publicKey))
+}
+
+func bootstrap(client *alpenhorn.Client) error {
+	addFriendConfig, err := client.ConfigClient.CurrentConfig("AddFriend")
+	if err != nil {
+		return errors.Wrap(err, "fetching add-friend config")
+	}
+	dialingConfig, err := client.ConfigClient.CurrentConfig("Dialing")
+	if err != nil {
+		return errors.Wrap(err, "fetching dialing config")
+	}
+	return client.Bootstrap(addFriendConfig, dialingConfig)
+}
+
+func doRegister(token string) {
+	client := loadClient()
+	addFriendConfig, err := client.ConfigClient.CurrentConfig("AddFriend")
+	if err != nil {
+		log.Fatalf("fetching add-friend config: %s", err)
+	}
+
+	failed := false
+	for _, pkgServer := range addFriendConfig.Inner.(*config.AddFriendConfig).PKGServers {
+		err := client.Register(pkgServer, token)
+		if err != nil {
+			fmt.Printf("%s: %s\n", pkgServer.Address, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: registered\n", pkgServer.Address)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func loadClient() *alpenhorn.Client {
+	clientPath, keywheelPath, callLogPath := clientPaths()
+	var client *alpenhorn.Client
+	var err error
+	if *usePassphrase {
+		client, err = alpenhorn.LoadClientWithPassphrase(clientPath, keywheelPath, readPassphrase())
+	} else {
+		client, err = alpenhorn.LoadClient(clientPath, keywheelPath)
+	}
+	if err != nil {
+		log.Fatalf("loading client (run init first?): %s", err)
+	}
+	client.ConfigClient = &config.Client{ConfigServerURL: *configServerURL}
+	client.CallLogPersistPath = callLogPath
+	return client
+}
+
+func readPassphrase() []byte {
+	fmt.Fprintf(os.Stderr, "Enter passphrase: ")
+	pw, err := terminal.ReadPassword(0)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		log.Fatalf("terminal.ReadPassword: %s", err)
+	}
+	return pw
+}
+
+func doCall(args []string) {
+	client := loadClient()
+	stream := alpenhorn.NewEventStream(64)
+	client.Handler = stream
+
+	ctx, cancel := context.WithTimeout(context.Background(), *callTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		client.Run(ctx)
+		close(done)
+	}()
+
+	call, err := queueCall(client, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+loop:
+	for {
+		select {
+		case e := <-stream.Events():
+			printEvent(e)
+			// SendingCall fires once the onion carrying the call has been
+			// written to the connection, so it is safe to close it now.
+			if e, ok := e.(alpenhorn.SendingCallEvent); ok && e.Call == call {
+				break loop
+			}
+		case <-ctx.Done():
+			log.Fatalf("call not sent after %s", *callTimeout)
+		}
+	}
+	cancel()
+	<-done
+}
+
+func doREPL() {
+	client := loadClient()
+	stream := alpenhorn.NewEventStream(256)
+	client.Handler = stream
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.Run(ctx)
+		close(done)
+	}()
+	go func() {
+		for e := range stream.Events() {
+			printEvent(e)
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	fmt.Printf("Running as %s. Type \"help\" for commands.\n", client.Username)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				cancel()
+				<-done
+				return
+			}
+			args := strings.Fields(line)
+			if len(args) == 0 {
+				continue
+			}
+			switch args[0] {
+			case "help":
+				fmt.Print(usage[strings.Index(usage, "Client commands"):strings.Index(usage, "Outside the REPL")])
+			case "quit", "exit":
+				cancel()
+				<-done
+				return
+			case "call":
+				if _, err := queueCall(client, args[1:]); err != nil {
+					fmt.Printf("error: %s\n", err)
+				}
+			default:
+				if err := runCommand(client, args); err != nil {
+					fmt.Printf("error: %s\n", err)
+				}
+			}
+		case <-sigs:
+			cancel()
+			<-done
+			return
+		}
+	}
+}
+
+// runCommand runs a client command that doesn't need a connection.
+func runCommand(client *alpenhorn.Client, args []string) error {
+	switch args[0] {
+	case "whoami":
+		fmt.Printf("%s %s\n", client.Username, base32.EncodeToString(client.LongTermPublicKey))
+	case "add":
+		if len(args) != 2 && len(args) != 3 {
+			return errors.New("usage: add <username> [key]")
+		}
+		var key ed25519.PublicKey
+		if len(args) == 3 {
+			bs, err := base32.DecodeString(args[2])
+			if err != nil || len(bs) != ed25519.PublicKeySize {
+				return errors.New("invalid key: %s", args[2])
+			}
+			key = bs
+		}
+		if _, err := client.SendFriendRequest(args[1], key); err != nil {
+			return err
+		}
+		fmt.Printf("Queued friend request to %s\n", args[1])
+	case "requests":
+		for _, req := range client.GetIncomingFriendRequests() {
+			fmt.Printf("incoming %s %s\n", req.Username, base32.EncodeToString(req.LongTermKey))
+		}
+		for _, req := range client.GetOutgoingFriendRequests() {
+			fmt.Printf("queued   %s\n", req.Username)
+		}
+		for _, req := range client.GetSentFriendRequests() {
+			fmt.Printf("sent     %s\n", req.Username)
+		}
+	case "approve", "reject":
+		if len(args) != 2 {
+			return errors.New("usage: %s <username>", args[0])
+		}
+		req := findIncoming(client, args[1])
+		if req == nil {
+			return errors.New("no friend request from %s", args[1])
+		}
+		if args[0] == "approve" {
+			_, err := req.Approve()
+			return err
+		}
+		return req.Reject()
+	case "friends":
+		for _, friend := range client.GetFriends() {
+			verified := ""
+			if friend.Verified() {
+				verified = " (verified)"
+			}
+			fmt.Printf("%s %s%s\n", friend.Username, base32.EncodeToString(friend.LongTermKey), verified)
+		}
+	default:
+		return errors.New("unknown command: %s", args[0])
+	}
+	return nil
+}
+
+func findIncoming(client *alpenhorn.Client, username string) *alpenhorn.IncomingFriendRequest {
+	for _, req := range client.GetIncomingFriendRequests() {
+		if req.Username == username {
+			return req
+		}
+	}
+	return nil
+}
+
+func queueCall(client *alpenhorn.Client, args []string) (*alpenhorn.OutgoingCall, error) {
+	if len(args) != 2 {
+		return nil, errors.New("usage: call <username> <intent>")
+	}
+	friend := client.GetFriend(args[0])
+	if friend == nil {
+		return nil, errors.New("not a friend: %s", args[0])
+	}
+	intent, err := strconv.Atoi(args[1])
+	if err != nil || intent < 0 || intent >= client.NumIntents() {
+		return nil, errors.New("intent must be between 0 and %d", client.NumIntents()-1)
+	}
+	return friend.CallIntent(intent)
+}
+
+func printEvent(e alpenhorn.Event) {
+	switch e := e.(type) {
+	case alpenhorn.ErrorEvent:
+		fmt.Printf("! error: %s\n", e.Err)
+	case alpenhorn.ConfirmedFriendEvent:
+		fmt.Printf("! confirmed friend: %s\n", e.Friend.Username)
+	case alpenhorn.SentFriendRequestEvent:
+		fmt.Printf("! sent friend request to %s\n", e.Request.Username)
+	case alpenhorn.ReceivedFriendRequestEvent:
+		fmt.Printf("! received friend request from %s (key %s)\n", e.Request.Username, base32.EncodeToString(e.Request.LongTermKey))
+	case alpenhorn.FriendRequestExpiredEvent:
+		if e.Incoming != nil {
+			fmt.Printf("! friend request from %s expired\n", e.Incoming.Username)
+		} else {
+			fmt.Printf("! friend request to %s expired\n", e.Outgoing.Username)
+		}
+	case alpenhorn.UnexpectedSigningKeyEvent:
+		fmt.Printf("! %s replied with unexpected key %s\n", e.Incoming.Username, base32.EncodeToString(e.Incoming.LongTermKey))
+	case alpenhorn.FriendKeyChangedEvent:
+		fmt.Printf("! key changed for %s\n", e.Friend.Username)
+	case alpenhorn.FriendRekeyedEvent:
+		fmt.Printf("! rekeyed friend: %s\n", e.Friend.Username)
+	case alpenhorn.SendingCallEvent:
+		fmt.Printf("! calling %s (intent %d)\n", e.Call.Username, e.Call.Intent())
+	case alpenhorn.ReceivedCallEvent:
+		fmt.Printf("! call from %s (intent %d)\n", e.Call.Username, e.Call.Intent)
+	case alpenhorn.NewConfigEvent:
+		fmt.Printf("! new %s config\n", e.Chain[0].Service)
+	case alpenhorn.ConnectionEvent:
+		if e.Err != nil {
+			fmt.Printf("! %s: %s: %s\n", e.Service, e.State, e.Err)
+		} else {
+			fmt.Printf("! %s: %s\n", e.Service, e.State)
+		}
+	}
+}
@@ -65,6 +65,9 @@ listenAddr = {{.ListenAddr | printf "%q"}}
 addFriendDelay = {{.AddFriendDelay | printf "%q"}}
 dialingDelay   = {{.DialingDelay | printf "%q"}}
 
+# mixWait, pkgWait, and the mailbox counts are only used when the
+# service's signed config doesn't set them (config versions before 4).
+
 # mixWait is how long to wait after announcing the mixnet round
 # settings and before closing the round.
 mixWait = {{.MixWait | printf "%q"}}
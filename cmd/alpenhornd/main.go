@@ -0,0 +1,522 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Command alpenhornd runs a persisted Alpenhorn client and exposes it to
+// local applications over HTTP on a Unix socket.
+//
+// Every request must carry the token from the token file in an
+// "Authorization: Bearer <token>" header. Commands are sent as JSON
+// objects to POST /rpc:
+//
+//	{"method": "call", "params": {"username": "bob@example.org", "intent": 0}}
+//
+// and the response is {"result": ...} or {"error": "..."}. Events are
+// streamed from GET /events as newline-delimited JSON objects. Call
+// events include the call's session key only if the subscriber asks for
+// it with GET /events?sessionKeys=1.
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"alpenhorn"
+	"alpenhorn/config"
+	"alpenhorn/errors"
+	"alpenhorn/log"
+
+	"vuvuzela.io/crypto/rand"
+)
+
+var (
+	persistPath     = flag.String("persist", "persist_client", "client data directory (see alpenhorn-client init)")
+	socketPath      = flag.String("socket", "", "Unix socket path (default <persist>/alpenhornd.sock)")
+	configServerURL = flag.String("config-server", config.StdClient.ConfigServerURL, "config server URL")
+	usePassphrase   = flag.Bool("passphrase", false, "prompt for the passphrase that encrypts the client data")
+	logCalls        = flag.Bool("calllog", false, "keep a log of calls in <persist>/calls")
+)
+
+func main() {
+	flag.Parse()
+	if *socketPath == "" {
+		*socketPath = filepath.Join(*persistPath, "alpenhornd.sock")
+	}
+
+	clientPath := filepath.Join(*persistPath, "client")
+	keywheelPath := filepath.Join(*persistPath, "keywheel")
+	var client *alpenhorn.Client
+	var err error
+	if *usePassphrase {
+		client, err = alpenhorn.LoadClientWithPassphrase(clientPath, keywheelPath, readPassphrase())
+	} else {
+		client, err = alpenhorn.LoadClient(clientPath, keywheelPath)
+	}
+	if err != nil {
+		log.Fatalf("loading client: %s", err)
+	}
+	client.ConfigClient = &config.Client{ConfigServerURL: *configServerURL}
+	if *logCalls {
+		client.CallLogPersistPath = filepath.Join(*persistPath, "calls")
+	}
+
+	tokenPath := filepath.Join(*persistPath, "alpenhornd.token")
+	token, err := loadOrCreateToken(tokenPath)
+	if err != nil {
+		log.Fatalf("auth token: %s", err)
+	}
+
+	stream := alpenhorn.NewEventStream(256)
+	client.Handler = stream
+	d := &daemon{
+		client:      client,
+		token:       token,
+		subscribers: make(map[*subscriber]bool),
+	}
+	go d.broadcast(stream)
+
+	listener, err := listenUnix(*socketPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rpc", d.authorized(d.rpcHandler))
+	mux.HandleFunc("/events", d.authorized(d.eventsHandler))
+	server := &http.Server{Handler: mux}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan struct{})
+	go func() {
+		client.Run(ctx)
+		close(runDone)
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		log.Infof("Shutting down")
+		cancel()
+		<-runDone
+		server.Close()
+	}()
+
+	log.Infof("Listening on %s as %s; token in %s", *socketPath, client.Username, tokenPath)
+	err = server.Serve(listener)
+	os.Remove(*socketPath)
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+func readPassphrase() []byte {
+	fmt.Fprintf(os.Stderr, "Enter passphrase: ")
+	pw, err := terminal.ReadPassword(0)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		log.Fatalf("terminal.ReadPassword: %s", err)
+	}
+	return pw
+}
+
+// listenUnix listens on a Unix socket that only the local user may
+// connect to. It replaces a stale socket at path, but nothing else.
+func listenUnix(path string) (net.Listener, error) {
+	fi, err := os.Lstat(path)
+	if err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Set the umask so the socket never has looser permissions than 0600.
+	mask := syscall.Umask(0077)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+	return listener, err
+}
+
+func loadOrCreateToken(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	token := base32.EncodeToString(b[:])
+	if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+type daemon struct {
+	client *alpenhorn.Client
+	token  string
+
+	mu          sync.Mutex
+	subscribers map[*subscriber]bool
+}
+
+type subscriber struct {
+	ch          chan []byte
+	done        chan struct{}
+	sessionKeys bool
+}
+
+func (d *daemon) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(d.token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+type rpcRequest struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+func (d *daemon) rpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "expecting POST", http.StatusMethodNotAllowed)
+		return
+	}
+	req := new(rpcRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var resp rpcResponse
+	result, err := d.dispatch(req.Method, req.Params)
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Result = result
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+type params struct {
+	Username string `json:"username"`
+	Key      string `json:"key"`
+	Intent   int    `json:"intent"`
+}
+
+func (d *daemon) dispatch(method string, raw json.RawMessage) (interface{}, error) {
+	var p params
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, errors.Wrap(err, "invalid params")
+		}
+	}
+	c := d.client
+
+	switch method {
+	case "whoami":
+		return friendInfo{Username: c.Username, LongTermKey: encodeKey(c.LongTermPublicKey)}, nil
+	case "friends":
+		friends := c.GetFriends()
+		infos := make([]friendInfo, len(friends))
+		for i, f := range friends {
+			infos[i] = newFriendInfo(f)
+		}
+		return infos, nil
+	case "removeFriend":
+		f := c.GetFriend(p.Username)
+		if f == nil {
+			return nil, errors.New("not a friend: %s", p.Username)
+		}
+		return true, f.Remove()
+	case "friendRequests":
+		var reqs struct {
+			Incoming []requestInfo `json:"incoming"`
+			Outgoing []requestInfo `json:"outgoing"`
+			Sent     []requestInfo `json:"sent"`
+		}
+		for _, r := range c.GetIncomingFriendRequests() {
+			reqs.Incoming = append(reqs.Incoming, requestInfo{Username: r.Username, LongTermKey: encodeKey(r.LongTermKey)})
+		}
+		for _, r := range c.GetOutgoingFriendRequests() {
+			reqs.Outgoing = append(reqs.Outgoing, requestInfo{Username: r.Username, LongTermKey: encodeKey(r.ExpectedKey)})
+		}
+		for _, r := range c.GetSentFriendRequests() {
+			reqs.Sent = append(reqs.Sent, requestInfo{Username: r.Username, LongTermKey: encodeKey(r.ExpectedKey)})
+		}
+		return reqs, nil
+	case "sendFriendRequest":
+		var key ed25519.PublicKey
+		if p.Key != "" {
+			bs, err := base32.DecodeString(p.Key)
+			if err != nil || len(bs) != ed25519.PublicKeySize {
+				return nil, errors.New("invalid key: %s", p.Key)
+			}
+			key = bs
+		}
+		_, err := c.SendFriendRequest(p.Username, key)
+		return true, err
+	case "approveFriendRequest", "rejectFriendRequest":
+		var req *alpenhorn.IncomingFriendRequest
+		for _, r := range c.GetIncomingFriendRequests() {
+			if r.Username == p.Username {
+				req = r
+			}
+		}
+		if req == nil {
+			return nil, errors.New("no friend request from %s", p.Username)
+		}
+		if method == "approveFriendRequest" {
+			_, err := req.Approve()
+			return true, err
+		}
+		return true, req.Reject()
+	case "call":
+		f := c.GetFriend(p.Username)
+		if f == nil {
+			return nil, errors.New("not a friend: %s", p.Username)
+		}
+		if _, err := f.CallIntent(p.Intent); err != nil {
+			return nil, err
+		}
+		return true, nil
+	case "callHistory":
+		return c.CallHistory()
+	case "pkgStatus":
+		statuses := c.PKGStatus()
+		infos := make([]pkgStatusInfo, len(statuses))
+		for i, st := range statuses {
+			infos[i].Address = st.Server.Address
+			if st.Error != nil {
+				infos[i].Error = st.Error.Error()
+			}
+		}
+		return infos, nil
+	default:
+		return nil, errors.New("unknown method: %q", method)
+	}
+}
+
+type friendInfo struct {
+	Username    string `json:"username"`
+	LongTermKey string `json:"longTermKey"`
+	Verified    bool   `json:"verified,omitempty"`
+}
+
+func newFriendInfo(f *alpenhorn.Friend) friendInfo {
+	return friendInfo{
+		Username:    f.Username,
+		LongTermKey: encodeKey(f.LongTermKey),
+		Verified:    f.Verified(),
+	}
+}
+
+type requestInfo struct {
+	Username    string `json:"username"`
+	LongTermKey string `json:"longTermKey,omitempty"`
+}
+
+type pkgStatusInfo struct {
+	Address string `json:"address"`
+	Error   string `json:"error,omitempty"`
+}
+
+type callInfo struct {
+	Username   string `json:"username"`
+	Intent     int    `json:"intent"`
+	SessionKey string `json:"sessionKey,omitempty"`
+}
+
+func encodeKey(key []byte) string {
+	if key == nil {
+		return ""
+	}
+	return base32.EncodeToString(key)
+}
+
+// eventJSON converts an event to the object sent to subscribers.
+// Session keys are only included if withKeys is true.
+func eventJSON(e alpenhorn.Event, withKeys bool) map[string]interface{} {
+	switch e := e.(type) {
+	case alpenhorn.ErrorEvent:
+		return map[string]interface{}{"type": "error", "error": e.Err.Error()}
+	case alpenhorn.ConfirmedFriendEvent:
+		return map[string]interface{}{"type": "confirmedFriend", "friend": newFriendInfo(e.Friend)}
+	case alpenhorn.SentFriendRequestEvent:
+		return map[string]interface{}{"type": "sentFriendRequest", "username": e.Request.Username}
+	case alpenhorn.ReceivedFriendRequestEvent:
+		return map[string]interface{}{"type": "receivedFriendRequest", "request": requestInfo{
+			Username:    e.Request.Username,
+			LongTermKey: encodeKey(e.Request.LongTermKey),
+		}}
+	case alpenhorn.FriendRequestExpiredEvent:
+		if e.Incoming != nil {
+			return map[string]interface{}{"type": "friendRequestExpired", "incoming": true, "username": e.Incoming.Username}
+		}
+		return map[string]interface{}{"type": "friendRequestExpired", "incoming": false, "username": e.Outgoing.Username}
+	case alpenhorn.UnexpectedSigningKeyEvent:
+		return map[string]interface{}{"type": "unexpectedSigningKey", "request": requestInfo{
+			Username:    e.Incoming.Username,
+			LongTermKey: encodeKey(e.Incoming.LongTermKey),
+		}}
+	case alpenhorn.FriendKeyChangedEvent:
+		return map[string]interface{}{"type": "friendKeyChanged", "friend": newFriendInfo(e.Friend), "oldKey": encodeKey(e.OldKey)}
+	case alpenhorn.FriendRekeyedEvent:
+		return map[string]interface{}{"type": "friendRekeyed", "friend": newFriendInfo(e.Friend)}
+	case alpenhorn.SendingCallEvent:
+		call := callInfo{Username: e.Call.Username, Intent: e.Call.Intent()}
+		if withKeys {
+			call.SessionKey = encodeKey(e.Call.SessionKey()[:])
+		}
+		return map[string]interface{}{"type": "sendingCall", "call": call}
+	case alpenhorn.ReceivedCallEvent:
+		call := callInfo{Username: e.Call.Username, Intent: e.Call.Intent}
+		if withKeys {
+			call.SessionKey = encodeKey(e.Call.SessionKey[:])
+		}
+		return map[string]interface{}{"type": "receivedCall", "call": call}
+	case alpenhorn.NewConfigEvent:
+		return map[string]interface{}{"type": "newConfig", "service": e.Chain[0].Service}
+	case alpenhorn.ConnectionEvent:
+		m := map[string]interface{}{"type": "connection", "service": e.Service, "state": e.State.String()}
+		if e.Err != nil {
+			m["error"] = e.Err.Error()
+		}
+		return m
+	}
+	return nil
+}
+
+// broadcast sends the client's events to every subscriber. Slow
+// subscribers miss events rather than holding up the others, except for
+// call events: a call can't be recovered later, so broadcast waits until
+// every subscriber has taken it (or disconnected).
+func (d *daemon) broadcast(stream *alpenhorn.EventStream) {
+	for e := range stream.Events() {
+		plain := encodeEvent(e, false)
+		if plain == nil {
+			continue
+		}
+		withKeys := encodeEvent(e, true)
+
+		var isCall bool
+		switch e.(type) {
+		case alpenhorn.SendingCallEvent, alpenhorn.ReceivedCallEvent:
+			isCall = true
+		}
+
+		d.mu.Lock()
+		subs := make([]*subscriber, 0, len(d.subscribers))
+		for sub := range d.subscribers {
+			subs = append(subs, sub)
+		}
+		d.mu.Unlock()
+
+		for _, sub := range subs {
+			data := plain
+			if sub.sessionKeys {
+				data = withKeys
+			}
+			if isCall {
+				select {
+				case sub.ch <- data:
+				case <-sub.done:
+				}
+				continue
+			}
+			select {
+			case sub.ch <- data:
+			default:
+			}
+		}
+	}
+}
+
+func encodeEvent(e alpenhorn.Event, withKeys bool) []byte {
+	m := eventJSON(e, withKeys)
+	if m == nil {
+		return nil
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		log.Errorf("encoding event: %s", err)
+		return nil
+	}
+	return append(data, '\n')
+}
+
+func (d *daemon) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := &subscriber{
+		ch:          make(chan []byte, 64),
+		done:        make(chan struct{}),
+		sessionKeys: r.URL.Query().Get("sessionKeys") == "1",
+	}
+	d.mu.Lock()
+	d.subscribers[sub] = true
+	d.mu.Unlock()
+	defer func() {
+		close(sub.done)
+		d.mu.Lock()
+		delete(d.subscribers, sub)
+		d.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case data := <-sub.ch:
+			if _, err := w.Write(data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
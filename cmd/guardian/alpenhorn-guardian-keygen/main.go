@@ -15,10 +15,10 @@ import (
 	"path/filepath"
 
 	"github.com/davidlazar/go-crypto/encoding/base32"
-	"golang.org/x/crypto/nacl/secretbox"
 	"golang.org/x/crypto/ssh/terminal"
 
 	"alpenhorn/cmd/guardian"
+	"alpenhorn/internal/passbox"
 )
 
 var inspirationalMessage = `
@@ -54,13 +54,7 @@ func main() {
 	dk := guardian.DeriveKey(pw)
 	var boxKey [32]byte
 	copy(boxKey[:], dk)
-	var nonce [24]byte
-	_, err = rand.Read(nonce[:])
-	if err != nil {
-		panic(err)
-	}
-	msg := privateKey[:]
-	ctxt := secretbox.Seal(nonce[:], msg, &nonce, &boxKey)
+	ctxt := passbox.Seal(privateKey[:], &boxKey)
 
 	err = ioutil.WriteFile(publicPath, []byte(base32.EncodeToString(publicKey[:])+"\n"), 0600)
 	if err != nil {
@@ -15,9 +15,9 @@ import (
 	"strings"
 
 	"github.com/davidlazar/go-crypto/encoding/base32"
-	"golang.org/x/crypto/nacl/secretbox"
-	"golang.org/x/crypto/scrypt"
 	"golang.org/x/crypto/ssh/terminal"
+
+	"alpenhorn/internal/passbox"
 )
 
 func Appdir() string {
@@ -29,15 +29,10 @@ func Appdir() string {
 }
 
 func DeriveKey(passphrase []byte) []byte {
-	dk, err := scrypt.Key(passphrase, []byte("alpenhorn-guardian"), 2<<15, 8, 1, 32)
-	if err != nil {
-		panic(err)
-	}
-	return dk
+	dk := passbox.DeriveKey(passphrase, []byte("alpenhorn-guardian"))
+	return dk[:]
 }
 
-const nonceOverhead = 24
-
 func ReadPrivateKey(path string) ed25519.PrivateKey {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -49,15 +44,11 @@ func ReadPrivateKey(path string) ed25519.PrivateKey {
 		log.Fatalf("error decoding base32: %s: %s", path, err)
 	}
 
-	expectedSize := nonceOverhead + ed25519.PrivateKeySize + secretbox.Overhead
+	expectedSize := ed25519.PrivateKeySize + passbox.Overhead
 	if len(bs) != expectedSize {
 		log.Fatalf("unexpected key length: got %d bytes, want %d", len(bs), expectedSize)
 	}
 
-	var nonce [24]byte
-	copy(nonce[:], bs[0:24])
-	ctxt := bs[24:]
-
 	for {
 		fmt.Fprintf(os.Stderr, "Enter passphrase for guardian key: ")
 		pw, err := terminal.ReadPassword(0)
@@ -70,7 +61,7 @@ func ReadPrivateKey(path string) ed25519.PrivateKey {
 		var boxKey [32]byte
 		copy(boxKey[:], dk)
 
-		msg, ok := secretbox.Open(nil, ctxt, &nonce, &boxKey)
+		msg, ok := passbox.Open(bs, &boxKey)
 		if ok {
 			privateKey := ed25519.PrivateKey(msg)
 			return privateKey
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sync"
 	"time"
 
 	"alpenhorn/internal/debug"
@@ -24,6 +25,25 @@ var StdClient = &Client{
 
 type Client struct {
 	ConfigServerURL string
+
+	mu       sync.Mutex
+	chains   map[chainKey]*chainFetch
+	lastUsed uint64
+}
+
+// maxCachedChains is the number of verified chains a Client remembers.
+const maxCachedChains = 32
+
+type chainKey struct {
+	have, want string
+}
+
+// chainFetch is a verified config chain, or a fetch that is in progress.
+type chainFetch struct {
+	done     chan struct{}
+	configs  []*SignedConfig
+	err      error
+	lastUsed uint64
 }
 
 var httpClient = &http.Client{
@@ -68,7 +88,67 @@ func (c *Client) CurrentConfig(service string) (*SignedConfig, error) {
 // FetchAndVerifyChain fetches and verifies a config chain starting with
 // the have config and ending with the want config. The chain is returned
 // in reverse order so chain[0].Hash() = want and chain[len(chain)-1] = have.
+//
+// The client remembers the chains it has verified, so callers that share
+// a Client (such as the identities in an alpenhorn.Manager) fetch and
+// verify each chain once, even if they ask for it at the same time.
 func (c *Client) FetchAndVerifyChain(have *SignedConfig, want string) ([]*SignedConfig, error) {
+	key := chainKey{have: have.Hash(), want: want}
+
+	c.mu.Lock()
+	f, ok := c.chains[key]
+	if !ok {
+		if c.chains == nil {
+			c.chains = make(map[chainKey]*chainFetch)
+		}
+		if len(c.chains) >= maxCachedChains {
+			c.evictLocked()
+		}
+		f = &chainFetch{done: make(chan struct{})}
+		c.chains[key] = f
+	}
+	c.lastUsed++
+	f.lastUsed = c.lastUsed
+	c.mu.Unlock()
+
+	if !ok {
+		f.configs, f.err = c.fetchAndVerifyChain(have, want)
+		if f.err != nil {
+			c.mu.Lock()
+			if c.chains[key] == f {
+				delete(c.chains, key)
+			}
+			c.mu.Unlock()
+		}
+		close(f.done)
+	} else {
+		<-f.done
+	}
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	if time.Now().After(f.configs[0].Expires) {
+		return nil, errors.New("config expired on %s", f.configs[0].Expires)
+	}
+	configs := make([]*SignedConfig, len(f.configs))
+	copy(configs, f.configs)
+	return configs, nil
+}
+
+// evictLocked forgets the least recently used chain.
+func (c *Client) evictLocked() {
+	var oldest chainKey
+	var oldestUse uint64
+	for key, f := range c.chains {
+		if oldestUse == 0 || f.lastUsed < oldestUse {
+			oldest, oldestUse = key, f.lastUsed
+		}
+	}
+	delete(c.chains, oldest)
+}
+
+func (c *Client) fetchAndVerifyChain(have *SignedConfig, want string) ([]*SignedConfig, error) {
 	url := fmt.Sprintf("%s/getchain?have=%s&want=%s", c.ConfigServerURL, have.Hash(), want)
 	resp, err := http.Get(url)
 	if err != nil {
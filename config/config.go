@@ -283,7 +283,7 @@ func init() {
 	RegisterService("Dialing", &DialingConfig{})
 }
 
-const AddFriendConfigVersion = 2
+const AddFriendConfigVersion = 4
 
 type AddFriendConfig struct {
 	Version     int
@@ -292,6 +292,35 @@ type AddFriendConfig struct {
 	MixServers  []mixnet.PublicServerConfig
 	CDNServer   CDNServerConfig
 	Registrar   RegistrarConfig
+
+	// IntrosPerRound is the number of onions every client sends in each
+	// add-friend round, at most MaxIntrosPerRound. Each onion carries a
+	// friend request or cover traffic. Zero means one. Versions before 3
+	// always use one.
+	IntrosPerRound int
+
+	// NumMailboxes, PKGWait, and MixWait are the round parameters
+	// that the coordinator must use. Clients reject rounds whose
+	// number of mailboxes disagrees with NumMailboxes. Clients can't
+	// check the coordinator's timing, so PKGWait and MixWait only bind
+	// a coordinator that follows the config. Zero means the coordinator
+	// chooses, which is the only option before version 4.
+	NumMailboxes uint32
+	PKGWait      time.Duration
+	MixWait      time.Duration
+}
+
+// MaxIntrosPerRound limits IntrosPerRound. Every client builds that many
+// onions in each add-friend round, each with an IBE encryption for every
+// PKG server, whether or not it has friend requests to send.
+const MaxIntrosPerRound = 16
+
+// NumIntros returns the number of onions a client sends per round.
+func (c *AddFriendConfig) NumIntros() int {
+	if c.IntrosPerRound <= 0 {
+		return 1
+	}
+	return c.IntrosPerRound
 }
 
 func (c *AddFriendConfig) UseLatestVersion() {
@@ -336,6 +365,31 @@ type addFriendV2 struct {
 	Registrar   keyAddr
 }
 
+//easyjson:readable
+type addFriendV3 struct {
+	Version        int
+	Coordinator    keyAddr
+	PKGServers     []keyAddr
+	MixServers     []keyAddr
+	CDNServer      keyAddr
+	Registrar      keyAddr
+	IntrosPerRound int
+}
+
+//easyjson:readable
+type addFriendV4 struct {
+	Version        int
+	Coordinator    keyAddr
+	PKGServers     []keyAddr
+	MixServers     []keyAddr
+	CDNServer      keyAddr
+	Registrar      keyAddr
+	IntrosPerRound int
+	NumMailboxes   uint32
+	PKGWait        time.Duration
+	MixWait        time.Duration
+}
+
 //easyjson:readable
 type keyAddr struct {
 	Key     ed25519.PublicKey
@@ -378,6 +432,47 @@ func (c *AddFriendConfig) v2() (*addFriendV2, error) {
 	return c2, nil
 }
 
+func (c *AddFriendConfig) v3() (*addFriendV3, error) {
+	c3 := &addFriendV3{
+		Version:        3,
+		Coordinator:    keyAddr{c.Coordinator.Key, c.Coordinator.Address},
+		PKGServers:     make([]keyAddr, len(c.PKGServers)),
+		MixServers:     make([]keyAddr, len(c.MixServers)),
+		CDNServer:      keyAddr{c.CDNServer.Key, c.CDNServer.Address},
+		Registrar:      keyAddr{c.Registrar.Key, c.Registrar.Address},
+		IntrosPerRound: c.IntrosPerRound,
+	}
+	for i, srv := range c.PKGServers {
+		c3.PKGServers[i] = keyAddr{srv.Key, srv.Address}
+	}
+	for i, srv := range c.MixServers {
+		c3.MixServers[i] = keyAddr{srv.Key, srv.Address}
+	}
+	return c3, nil
+}
+
+func (c *AddFriendConfig) v4() (*addFriendV4, error) {
+	c4 := &addFriendV4{
+		Version:        4,
+		Coordinator:    keyAddr{c.Coordinator.Key, c.Coordinator.Address},
+		PKGServers:     make([]keyAddr, len(c.PKGServers)),
+		MixServers:     make([]keyAddr, len(c.MixServers)),
+		CDNServer:      keyAddr{c.CDNServer.Key, c.CDNServer.Address},
+		Registrar:      keyAddr{c.Registrar.Key, c.Registrar.Address},
+		IntrosPerRound: c.IntrosPerRound,
+		NumMailboxes:   c.NumMailboxes,
+		PKGWait:        c.PKGWait,
+		MixWait:        c.MixWait,
+	}
+	for i, srv := range c.PKGServers {
+		c4.PKGServers[i] = keyAddr{srv.Key, srv.Address}
+	}
+	for i, srv := range c.MixServers {
+		c4.MixServers[i] = keyAddr{srv.Key, srv.Address}
+	}
+	return c4, nil
+}
+
 func (c *AddFriendConfig) fromV1(c1 *addFriendV1) error {
 	c.Version = 1
 	c.Coordinator = CoordinatorConfig{c1.Coordinator.Key, c1.Coordinator.Address}
@@ -410,6 +505,43 @@ func (c *AddFriendConfig) fromV2(c2 *addFriendV2) error {
 	return nil
 }
 
+func (c *AddFriendConfig) fromV3(c3 *addFriendV3) error {
+	c.Version = 3
+	c.Coordinator = CoordinatorConfig{c3.Coordinator.Key, c3.Coordinator.Address}
+	c.PKGServers = make([]pkg.PublicServerConfig, len(c3.PKGServers))
+	c.MixServers = make([]mixnet.PublicServerConfig, len(c3.MixServers))
+	c.CDNServer = CDNServerConfig{c3.CDNServer.Key, c3.CDNServer.Address}
+	for i, srv := range c3.PKGServers {
+		c.PKGServers[i] = pkg.PublicServerConfig{Key: srv.Key, Address: srv.Address}
+	}
+	for i, srv := range c3.MixServers {
+		c.MixServers[i] = mixnet.PublicServerConfig{Key: srv.Key, Address: srv.Address}
+	}
+	c.Registrar = RegistrarConfig{c3.Registrar.Key, c3.Registrar.Address}
+	c.IntrosPerRound = c3.IntrosPerRound
+	return nil
+}
+
+func (c *AddFriendConfig) fromV4(c4 *addFriendV4) error {
+	c.Version = 4
+	c.Coordinator = CoordinatorConfig{c4.Coordinator.Key, c4.Coordinator.Address}
+	c.PKGServers = make([]pkg.PublicServerConfig, len(c4.PKGServers))
+	c.MixServers = make([]mixnet.PublicServerConfig, len(c4.MixServers))
+	c.CDNServer = CDNServerConfig{c4.CDNServer.Key, c4.CDNServer.Address}
+	for i, srv := range c4.PKGServers {
+		c.PKGServers[i] = pkg.PublicServerConfig{Key: srv.Key, Address: srv.Address}
+	}
+	for i, srv := range c4.MixServers {
+		c.MixServers[i] = mixnet.PublicServerConfig{Key: srv.Key, Address: srv.Address}
+	}
+	c.Registrar = RegistrarConfig{c4.Registrar.Key, c4.Registrar.Address}
+	c.IntrosPerRound = c4.IntrosPerRound
+	c.NumMailboxes = c4.NumMailboxes
+	c.PKGWait = c4.PKGWait
+	c.MixWait = c4.MixWait
+	return nil
+}
+
 func (c *AddFriendConfig) Validate() error {
 	if c.Version <= 0 {
 		return errors.New("invalid version number: %d", c.Version)
@@ -446,6 +578,19 @@ func (c *AddFriendConfig) Validate() error {
 		}
 	}
 
+	if c.IntrosPerRound < 0 || c.IntrosPerRound > MaxIntrosPerRound {
+		return errors.New("invalid intros per round: %d (max %d)", c.IntrosPerRound, MaxIntrosPerRound)
+	}
+	if c.IntrosPerRound > 1 && c.Version < 3 {
+		return errors.New("intros per round requires version 3, have version %d", c.Version)
+	}
+	if c.PKGWait < 0 || c.MixWait < 0 {
+		return errors.New("invalid round timing: pkgWait=%s mixWait=%s", c.PKGWait, c.MixWait)
+	}
+	if (c.NumMailboxes != 0 || c.PKGWait != 0 || c.MixWait != 0) && c.Version < 4 {
+		return errors.New("round parameters require version 4, have version %d", c.Version)
+	}
+
 	return nil
 }
 
@@ -463,6 +608,18 @@ func (c *AddFriendConfig) MarshalJSON() ([]byte, error) {
 			return nil, err
 		}
 		return json.Marshal(c2)
+	case 3:
+		c3, err := c.v3()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(c3)
+	case 4:
+		c4, err := c.v4()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(c4)
 	default:
 		return nil, errors.New("unknown AddFriendConfig version: %d", c.Version)
 	}
@@ -488,18 +645,80 @@ func (c *AddFriendConfig) UnmarshalJSON(data []byte) error {
 			return err
 		}
 		return c.fromV2(c2)
+	case 3:
+		c3 := new(addFriendV3)
+		err := json.Unmarshal(data, c3)
+		if err != nil {
+			return err
+		}
+		return c.fromV3(c3)
+	case 4:
+		c4 := new(addFriendV4)
+		err := json.Unmarshal(data, c4)
+		if err != nil {
+			return err
+		}
+		return c.fromV4(c4)
 	default:
 		return errors.New("unknown AddFriendConfig version: %d", version)
 	}
 }
 
-const DialingConfigVersion = 1
+const DialingConfigVersion = 4
+
+// DefaultIntents is the number of dialing intents in configs that
+// don't set Intents.
+const DefaultIntents = 3
+
+// MaxIntents limits Intents. Clients test a dial token for every
+// friend and intent against each round's bloom filter, so the number
+// of intents multiplies the filter's false positive rate.
+const MaxIntents = 16
 
 type DialingConfig struct {
 	Version     int
 	Coordinator CoordinatorConfig
 	MixServers  []mixnet.PublicServerConfig
 	CDNServer   CDNServerConfig
+
+	// CallsPerRound is the number of onions every client sends in each
+	// dialing round, at most MaxCallsPerRound. Each onion carries a call
+	// or cover traffic. Zero means one. Version 1 always uses one.
+	CallsPerRound int
+
+	// Intents is the number of distinct intents a call can have, at
+	// most MaxIntents. Zero means DefaultIntents. Versions before 3
+	// always use DefaultIntents.
+	Intents int
+
+	// NumMailboxes and MixWait are the round parameters that the
+	// coordinator must use. Clients reject rounds whose number of
+	// mailboxes disagrees with NumMailboxes, but they can't check
+	// MixWait; see AddFriendConfig. Zero means the coordinator
+	// chooses, which is the only option before version 4.
+	NumMailboxes uint32
+	MixWait      time.Duration
+}
+
+// NumIntents returns the number of intents a call can have.
+func (c *DialingConfig) NumIntents() int {
+	if c.Intents <= 0 {
+		return DefaultIntents
+	}
+	return c.Intents
+}
+
+// MaxCallsPerRound limits CallsPerRound. Every client builds and sends
+// that many onions in each dialing round, whether or not it has calls
+// to make.
+const MaxCallsPerRound = 16
+
+// NumCalls returns the number of onions a client sends per round.
+func (c *DialingConfig) NumCalls() int {
+	if c.CallsPerRound <= 0 {
+		return 1
+	}
+	return c.CallsPerRound
 }
 
 func (c *DialingConfig) UseLatestVersion() {
@@ -514,6 +733,37 @@ type dialingV1 struct {
 	CDNServer   keyAddr
 }
 
+//easyjson:readable
+type dialingV2 struct {
+	Version       int
+	Coordinator   keyAddr
+	MixServers    []keyAddr
+	CDNServer     keyAddr
+	CallsPerRound int
+}
+
+//easyjson:readable
+type dialingV3 struct {
+	Version       int
+	Coordinator   keyAddr
+	MixServers    []keyAddr
+	CDNServer     keyAddr
+	CallsPerRound int
+	Intents       int
+}
+
+//easyjson:readable
+type dialingV4 struct {
+	Version       int
+	Coordinator   keyAddr
+	MixServers    []keyAddr
+	CDNServer     keyAddr
+	CallsPerRound int
+	Intents       int
+	NumMailboxes  uint32
+	MixWait       time.Duration
+}
+
 func (c *DialingConfig) v1() (*dialingV1, error) {
 	c1 := &dialingV1{
 		Version:     1,
@@ -527,6 +777,52 @@ func (c *DialingConfig) v1() (*dialingV1, error) {
 	return c1, nil
 }
 
+func (c *DialingConfig) v2() (*dialingV2, error) {
+	c2 := &dialingV2{
+		Version:       2,
+		Coordinator:   keyAddr{c.Coordinator.Key, c.Coordinator.Address},
+		MixServers:    make([]keyAddr, len(c.MixServers)),
+		CDNServer:     keyAddr{c.CDNServer.Key, c.CDNServer.Address},
+		CallsPerRound: c.CallsPerRound,
+	}
+	for i, srv := range c.MixServers {
+		c2.MixServers[i] = keyAddr{srv.Key, srv.Address}
+	}
+	return c2, nil
+}
+
+func (c *DialingConfig) v3() (*dialingV3, error) {
+	c3 := &dialingV3{
+		Version:       3,
+		Coordinator:   keyAddr{c.Coordinator.Key, c.Coordinator.Address},
+		MixServers:    make([]keyAddr, len(c.MixServers)),
+		CDNServer:     keyAddr{c.CDNServer.Key, c.CDNServer.Address},
+		CallsPerRound: c.CallsPerRound,
+		Intents:       c.Intents,
+	}
+	for i, srv := range c.MixServers {
+		c3.MixServers[i] = keyAddr{srv.Key, srv.Address}
+	}
+	return c3, nil
+}
+
+func (c *DialingConfig) v4() (*dialingV4, error) {
+	c4 := &dialingV4{
+		Version:       4,
+		Coordinator:   keyAddr{c.Coordinator.Key, c.Coordinator.Address},
+		MixServers:    make([]keyAddr, len(c.MixServers)),
+		CDNServer:     keyAddr{c.CDNServer.Key, c.CDNServer.Address},
+		CallsPerRound: c.CallsPerRound,
+		Intents:       c.Intents,
+		NumMailboxes:  c.NumMailboxes,
+		MixWait:       c.MixWait,
+	}
+	for i, srv := range c.MixServers {
+		c4.MixServers[i] = keyAddr{srv.Key, srv.Address}
+	}
+	return c4, nil
+}
+
 func (c *DialingConfig) fromV1(c1 *dialingV1) error {
 	c.Version = 1
 	c.Coordinator = CoordinatorConfig{c1.Coordinator.Key, c1.Coordinator.Address}
@@ -538,6 +834,46 @@ func (c *DialingConfig) fromV1(c1 *dialingV1) error {
 	return nil
 }
 
+func (c *DialingConfig) fromV2(c2 *dialingV2) error {
+	c.Version = 2
+	c.Coordinator = CoordinatorConfig{c2.Coordinator.Key, c2.Coordinator.Address}
+	c.MixServers = make([]mixnet.PublicServerConfig, len(c2.MixServers))
+	c.CDNServer = CDNServerConfig{c2.CDNServer.Key, c2.CDNServer.Address}
+	for i, srv := range c2.MixServers {
+		c.MixServers[i] = mixnet.PublicServerConfig{Key: srv.Key, Address: srv.Address}
+	}
+	c.CallsPerRound = c2.CallsPerRound
+	return nil
+}
+
+func (c *DialingConfig) fromV3(c3 *dialingV3) error {
+	c.Version = 3
+	c.Coordinator = CoordinatorConfig{c3.Coordinator.Key, c3.Coordinator.Address}
+	c.MixServers = make([]mixnet.PublicServerConfig, len(c3.MixServers))
+	c.CDNServer = CDNServerConfig{c3.CDNServer.Key, c3.CDNServer.Address}
+	for i, srv := range c3.MixServers {
+		c.MixServers[i] = mixnet.PublicServerConfig{Key: srv.Key, Address: srv.Address}
+	}
+	c.CallsPerRound = c3.CallsPerRound
+	c.Intents = c3.Intents
+	return nil
+}
+
+func (c *DialingConfig) fromV4(c4 *dialingV4) error {
+	c.Version = 4
+	c.Coordinator = CoordinatorConfig{c4.Coordinator.Key, c4.Coordinator.Address}
+	c.MixServers = make([]mixnet.PublicServerConfig, len(c4.MixServers))
+	c.CDNServer = CDNServerConfig{c4.CDNServer.Key, c4.CDNServer.Address}
+	for i, srv := range c4.MixServers {
+		c.MixServers[i] = mixnet.PublicServerConfig{Key: srv.Key, Address: srv.Address}
+	}
+	c.CallsPerRound = c4.CallsPerRound
+	c.Intents = c4.Intents
+	c.NumMailboxes = c4.NumMailboxes
+	c.MixWait = c4.MixWait
+	return nil
+}
+
 func (c *DialingConfig) MarshalJSON() ([]byte, error) {
 	switch c.Version {
 	case 1:
@@ -546,6 +882,24 @@ func (c *DialingConfig) MarshalJSON() ([]byte, error) {
 			return nil, err
 		}
 		return json.Marshal(c1)
+	case 2:
+		c2, err := c.v2()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(c2)
+	case 3:
+		c3, err := c.v3()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(c3)
+	case 4:
+		c4, err := c.v4()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(c4)
 	default:
 		return nil, errors.New("unknown DialingConfig version: %d", c.Version)
 	}
@@ -564,6 +918,27 @@ func (c *DialingConfig) UnmarshalJSON(data []byte) error {
 			return err
 		}
 		return c.fromV1(c1)
+	case 2:
+		c2 := new(dialingV2)
+		err := json.Unmarshal(data, c2)
+		if err != nil {
+			return err
+		}
+		return c.fromV2(c2)
+	case 3:
+		c3 := new(dialingV3)
+		err := json.Unmarshal(data, c3)
+		if err != nil {
+			return err
+		}
+		return c.fromV3(c3)
+	case 4:
+		c4 := new(dialingV4)
+		err := json.Unmarshal(data, c4)
+		if err != nil {
+			return err
+		}
+		return c.fromV4(c4)
 	default:
 		return errors.New("unknown DialingConfig version: %d", version)
 	}
@@ -593,6 +968,25 @@ func (c *DialingConfig) Validate() error {
 		return errors.New("invalid key for cdn: %v", c.CDNServer.Key)
 	}
 
+	if c.CallsPerRound < 0 || c.CallsPerRound > MaxCallsPerRound {
+		return errors.New("invalid calls per round: %d (max %d)", c.CallsPerRound, MaxCallsPerRound)
+	}
+	if c.CallsPerRound > 1 && c.Version < 2 {
+		return errors.New("calls per round requires version 2, have version %d", c.Version)
+	}
+	if c.Intents < 0 || c.Intents > MaxIntents {
+		return errors.New("invalid number of intents: %d (max %d)", c.Intents, MaxIntents)
+	}
+	if c.Intents != 0 && c.Intents != DefaultIntents && c.Version < 3 {
+		return errors.New("intents requires version 3, have version %d", c.Version)
+	}
+	if c.MixWait < 0 {
+		return errors.New("invalid round timing: mixWait=%s", c.MixWait)
+	}
+	if (c.NumMailboxes != 0 || c.MixWait != 0) && c.Version < 4 {
+		return errors.New("round parameters require version 4, have version %d", c.Version)
+	}
+
 	return nil
 }
 
@@ -7,6 +7,7 @@ import (
 	easyjson "github.com/davidlazar/easyjson"
 	jlexer "github.com/davidlazar/easyjson/jlexer"
 	jwriter "github.com/davidlazar/easyjson/jwriter"
+	time "time"
 )
 
 // suppress unused package warning
@@ -296,7 +297,7 @@ func (v *keyAddr) UnmarshalJSON(data []byte) error {
 func (v *keyAddr) UnmarshalEasyJSON(l *jlexer.Lexer) {
 	easyjsonDecodeKeyAddr6615c02e(l, v)
 }
-func easyjsonDecodeDialingV16615c02e(in *jlexer.Lexer, out *dialingV1) {
+func easyjsonDecodeDialingV46615c02e(in *jlexer.Lexer, out *dialingV4) {
 	isTopLevel := in.IsStart()
 	if in.IsNull() {
 		if isTopLevel {
@@ -344,6 +345,14 @@ func easyjsonDecodeDialingV16615c02e(in *jlexer.Lexer, out *dialingV1) {
 			}
 		case "CDNServer":
 			(out.CDNServer).UnmarshalEasyJSON(in)
+		case "CallsPerRound":
+			out.CallsPerRound = int(in.Int())
+		case "Intents":
+			out.Intents = int(in.Int())
+		case "NumMailboxes":
+			out.NumMailboxes = uint32(in.Uint32())
+		case "MixWait":
+			out.MixWait = time.Duration(in.Int64())
 		default:
 			in.SkipRecursive()
 		}
@@ -354,7 +363,7 @@ func easyjsonDecodeDialingV16615c02e(in *jlexer.Lexer, out *dialingV1) {
 		in.Consumed()
 	}
 }
-func easyjsonEncodeDialingV16615c02e(out *jwriter.Writer, in dialingV1) {
+func easyjsonEncodeDialingV46615c02e(out *jwriter.Writer, in dialingV4) {
 	out.RawByte('{')
 	first := true
 	_ = first
@@ -393,31 +402,830 @@ func easyjsonEncodeDialingV16615c02e(out *jwriter.Writer, in dialingV1) {
 	first = false
 	out.RawString("\"CDNServer\":")
 	(in.CDNServer).MarshalEasyJSON(out)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"CallsPerRound\":")
+	out.Int(int(in.CallsPerRound))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Intents\":")
+	out.Int(int(in.Intents))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"NumMailboxes\":")
+	out.Uint32(uint32(in.NumMailboxes))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"MixWait\":")
+	out.Int64(int64(in.MixWait))
 	out.RawByte('}')
 }
 
 // MarshalJSON supports json.Marshaler interface
-func (v dialingV1) MarshalJSON() ([]byte, error) {
+func (v dialingV4) MarshalJSON() ([]byte, error) {
 	w := jwriter.Writer{}
-	easyjsonEncodeDialingV16615c02e(&w, v)
+	easyjsonEncodeDialingV46615c02e(&w, v)
 	return w.Buffer.BuildBytes(), w.Error
 }
 
 // MarshalEasyJSON supports easyjson.Marshaler interface
-func (v dialingV1) MarshalEasyJSON(w *jwriter.Writer) {
-	easyjsonEncodeDialingV16615c02e(w, v)
+func (v dialingV4) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonEncodeDialingV46615c02e(w, v)
 }
 
 // UnmarshalJSON supports json.Unmarshaler interface
-func (v *dialingV1) UnmarshalJSON(data []byte) error {
+func (v *dialingV4) UnmarshalJSON(data []byte) error {
 	r := jlexer.Lexer{Data: data}
-	easyjsonDecodeDialingV16615c02e(&r, v)
+	easyjsonDecodeDialingV46615c02e(&r, v)
 	return r.Error()
 }
 
 // UnmarshalEasyJSON supports easyjson.Unmarshaler interface
-func (v *dialingV1) UnmarshalEasyJSON(l *jlexer.Lexer) {
-	easyjsonDecodeDialingV16615c02e(l, v)
+func (v *dialingV4) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonDecodeDialingV46615c02e(l, v)
+}
+func easyjsonDecodeDialingV36615c02e(in *jlexer.Lexer, out *dialingV3) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "Version":
+			out.Version = int(in.Int())
+		case "Coordinator":
+			(out.Coordinator).UnmarshalEasyJSON(in)
+		case "MixServers":
+			if in.IsNull() {
+				in.Skip()
+				out.MixServers = nil
+			} else {
+				in.Delim('[')
+				if out.MixServers == nil {
+					if !in.IsDelim(']') {
+						out.MixServers = make([]keyAddr, 0, 1)
+					} else {
+						out.MixServers = []keyAddr{}
+					}
+				} else {
+					out.MixServers = (out.MixServers)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v12 keyAddr
+					(v12).UnmarshalEasyJSON(in)
+					out.MixServers = append(out.MixServers, v12)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "CDNServer":
+			(out.CDNServer).UnmarshalEasyJSON(in)
+		case "CallsPerRound":
+			out.CallsPerRound = int(in.Int())
+		case "Intents":
+			out.Intents = int(in.Int())
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonEncodeDialingV36615c02e(out *jwriter.Writer, in dialingV3) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Version\":")
+	out.Int(int(in.Version))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Coordinator\":")
+	(in.Coordinator).MarshalEasyJSON(out)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"MixServers\":")
+	if in.MixServers == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v13, v14 := range in.MixServers {
+			if v13 > 0 {
+				out.RawByte(',')
+			}
+			(v14).MarshalEasyJSON(out)
+		}
+		out.RawByte(']')
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"CDNServer\":")
+	(in.CDNServer).MarshalEasyJSON(out)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"CallsPerRound\":")
+	out.Int(int(in.CallsPerRound))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Intents\":")
+	out.Int(int(in.Intents))
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v dialingV3) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonEncodeDialingV36615c02e(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v dialingV3) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonEncodeDialingV36615c02e(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *dialingV3) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonDecodeDialingV36615c02e(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *dialingV3) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonDecodeDialingV36615c02e(l, v)
+}
+func easyjsonDecodeDialingV26615c02e(in *jlexer.Lexer, out *dialingV2) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "Version":
+			out.Version = int(in.Int())
+		case "Coordinator":
+			(out.Coordinator).UnmarshalEasyJSON(in)
+		case "MixServers":
+			if in.IsNull() {
+				in.Skip()
+				out.MixServers = nil
+			} else {
+				in.Delim('[')
+				if out.MixServers == nil {
+					if !in.IsDelim(']') {
+						out.MixServers = make([]keyAddr, 0, 1)
+					} else {
+						out.MixServers = []keyAddr{}
+					}
+				} else {
+					out.MixServers = (out.MixServers)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v12 keyAddr
+					(v12).UnmarshalEasyJSON(in)
+					out.MixServers = append(out.MixServers, v12)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "CDNServer":
+			(out.CDNServer).UnmarshalEasyJSON(in)
+		case "CallsPerRound":
+			out.CallsPerRound = int(in.Int())
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonEncodeDialingV26615c02e(out *jwriter.Writer, in dialingV2) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Version\":")
+	out.Int(int(in.Version))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Coordinator\":")
+	(in.Coordinator).MarshalEasyJSON(out)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"MixServers\":")
+	if in.MixServers == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v13, v14 := range in.MixServers {
+			if v13 > 0 {
+				out.RawByte(',')
+			}
+			(v14).MarshalEasyJSON(out)
+		}
+		out.RawByte(']')
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"CDNServer\":")
+	(in.CDNServer).MarshalEasyJSON(out)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"CallsPerRound\":")
+	out.Int(int(in.CallsPerRound))
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v dialingV2) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonEncodeDialingV26615c02e(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v dialingV2) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonEncodeDialingV26615c02e(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *dialingV2) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonDecodeDialingV26615c02e(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *dialingV2) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonDecodeDialingV26615c02e(l, v)
+}
+func easyjsonDecodeDialingV16615c02e(in *jlexer.Lexer, out *dialingV1) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "Version":
+			out.Version = int(in.Int())
+		case "Coordinator":
+			(out.Coordinator).UnmarshalEasyJSON(in)
+		case "MixServers":
+			if in.IsNull() {
+				in.Skip()
+				out.MixServers = nil
+			} else {
+				in.Delim('[')
+				if out.MixServers == nil {
+					if !in.IsDelim(']') {
+						out.MixServers = make([]keyAddr, 0, 1)
+					} else {
+						out.MixServers = []keyAddr{}
+					}
+				} else {
+					out.MixServers = (out.MixServers)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v12 keyAddr
+					(v12).UnmarshalEasyJSON(in)
+					out.MixServers = append(out.MixServers, v12)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "CDNServer":
+			(out.CDNServer).UnmarshalEasyJSON(in)
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonEncodeDialingV16615c02e(out *jwriter.Writer, in dialingV1) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Version\":")
+	out.Int(int(in.Version))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Coordinator\":")
+	(in.Coordinator).MarshalEasyJSON(out)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"MixServers\":")
+	if in.MixServers == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v13, v14 := range in.MixServers {
+			if v13 > 0 {
+				out.RawByte(',')
+			}
+			(v14).MarshalEasyJSON(out)
+		}
+		out.RawByte(']')
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"CDNServer\":")
+	(in.CDNServer).MarshalEasyJSON(out)
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v dialingV1) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonEncodeDialingV16615c02e(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v dialingV1) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonEncodeDialingV16615c02e(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *dialingV1) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonDecodeDialingV16615c02e(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *dialingV1) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonDecodeDialingV16615c02e(l, v)
+}
+func easyjsonDecodeAddFriendV46615c02e(in *jlexer.Lexer, out *addFriendV4) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "Version":
+			out.Version = int(in.Int())
+		case "Coordinator":
+			(out.Coordinator).UnmarshalEasyJSON(in)
+		case "PKGServers":
+			if in.IsNull() {
+				in.Skip()
+				out.PKGServers = nil
+			} else {
+				in.Delim('[')
+				if out.PKGServers == nil {
+					if !in.IsDelim(']') {
+						out.PKGServers = make([]keyAddr, 0, 1)
+					} else {
+						out.PKGServers = []keyAddr{}
+					}
+				} else {
+					out.PKGServers = (out.PKGServers)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v15 keyAddr
+					(v15).UnmarshalEasyJSON(in)
+					out.PKGServers = append(out.PKGServers, v15)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "MixServers":
+			if in.IsNull() {
+				in.Skip()
+				out.MixServers = nil
+			} else {
+				in.Delim('[')
+				if out.MixServers == nil {
+					if !in.IsDelim(']') {
+						out.MixServers = make([]keyAddr, 0, 1)
+					} else {
+						out.MixServers = []keyAddr{}
+					}
+				} else {
+					out.MixServers = (out.MixServers)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v16 keyAddr
+					(v16).UnmarshalEasyJSON(in)
+					out.MixServers = append(out.MixServers, v16)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "CDNServer":
+			(out.CDNServer).UnmarshalEasyJSON(in)
+		case "Registrar":
+			(out.Registrar).UnmarshalEasyJSON(in)
+		case "IntrosPerRound":
+			out.IntrosPerRound = int(in.Int())
+		case "NumMailboxes":
+			out.NumMailboxes = uint32(in.Uint32())
+		case "PKGWait":
+			out.PKGWait = time.Duration(in.Int64())
+		case "MixWait":
+			out.MixWait = time.Duration(in.Int64())
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonEncodeAddFriendV46615c02e(out *jwriter.Writer, in addFriendV4) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Version\":")
+	out.Int(int(in.Version))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Coordinator\":")
+	(in.Coordinator).MarshalEasyJSON(out)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"PKGServers\":")
+	if in.PKGServers == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v17, v18 := range in.PKGServers {
+			if v17 > 0 {
+				out.RawByte(',')
+			}
+			(v18).MarshalEasyJSON(out)
+		}
+		out.RawByte(']')
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"MixServers\":")
+	if in.MixServers == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v19, v20 := range in.MixServers {
+			if v19 > 0 {
+				out.RawByte(',')
+			}
+			(v20).MarshalEasyJSON(out)
+		}
+		out.RawByte(']')
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"CDNServer\":")
+	(in.CDNServer).MarshalEasyJSON(out)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Registrar\":")
+	(in.Registrar).MarshalEasyJSON(out)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"IntrosPerRound\":")
+	out.Int(int(in.IntrosPerRound))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"NumMailboxes\":")
+	out.Uint32(uint32(in.NumMailboxes))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"PKGWait\":")
+	out.Int64(int64(in.PKGWait))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"MixWait\":")
+	out.Int64(int64(in.MixWait))
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v addFriendV4) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonEncodeAddFriendV46615c02e(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v addFriendV4) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonEncodeAddFriendV46615c02e(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *addFriendV4) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonDecodeAddFriendV46615c02e(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *addFriendV4) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonDecodeAddFriendV46615c02e(l, v)
+}
+func easyjsonDecodeAddFriendV36615c02e(in *jlexer.Lexer, out *addFriendV3) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "Version":
+			out.Version = int(in.Int())
+		case "Coordinator":
+			(out.Coordinator).UnmarshalEasyJSON(in)
+		case "PKGServers":
+			if in.IsNull() {
+				in.Skip()
+				out.PKGServers = nil
+			} else {
+				in.Delim('[')
+				if out.PKGServers == nil {
+					if !in.IsDelim(']') {
+						out.PKGServers = make([]keyAddr, 0, 1)
+					} else {
+						out.PKGServers = []keyAddr{}
+					}
+				} else {
+					out.PKGServers = (out.PKGServers)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v15 keyAddr
+					(v15).UnmarshalEasyJSON(in)
+					out.PKGServers = append(out.PKGServers, v15)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "MixServers":
+			if in.IsNull() {
+				in.Skip()
+				out.MixServers = nil
+			} else {
+				in.Delim('[')
+				if out.MixServers == nil {
+					if !in.IsDelim(']') {
+						out.MixServers = make([]keyAddr, 0, 1)
+					} else {
+						out.MixServers = []keyAddr{}
+					}
+				} else {
+					out.MixServers = (out.MixServers)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v16 keyAddr
+					(v16).UnmarshalEasyJSON(in)
+					out.MixServers = append(out.MixServers, v16)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "CDNServer":
+			(out.CDNServer).UnmarshalEasyJSON(in)
+		case "Registrar":
+			(out.Registrar).UnmarshalEasyJSON(in)
+		case "IntrosPerRound":
+			out.IntrosPerRound = int(in.Int())
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonEncodeAddFriendV36615c02e(out *jwriter.Writer, in addFriendV3) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Version\":")
+	out.Int(int(in.Version))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Coordinator\":")
+	(in.Coordinator).MarshalEasyJSON(out)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"PKGServers\":")
+	if in.PKGServers == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v17, v18 := range in.PKGServers {
+			if v17 > 0 {
+				out.RawByte(',')
+			}
+			(v18).MarshalEasyJSON(out)
+		}
+		out.RawByte(']')
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"MixServers\":")
+	if in.MixServers == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v19, v20 := range in.MixServers {
+			if v19 > 0 {
+				out.RawByte(',')
+			}
+			(v20).MarshalEasyJSON(out)
+		}
+		out.RawByte(']')
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"CDNServer\":")
+	(in.CDNServer).MarshalEasyJSON(out)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Registrar\":")
+	(in.Registrar).MarshalEasyJSON(out)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"IntrosPerRound\":")
+	out.Int(int(in.IntrosPerRound))
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v addFriendV3) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonEncodeAddFriendV36615c02e(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v addFriendV3) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonEncodeAddFriendV36615c02e(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *addFriendV3) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonDecodeAddFriendV36615c02e(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *addFriendV3) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonDecodeAddFriendV36615c02e(l, v)
 }
 func easyjsonDecodeAddFriendV26615c02e(in *jlexer.Lexer, out *addFriendV2) {
 	isTopLevel := in.IsStart()
@@ -186,6 +186,10 @@ func TestMarshalAddFriendConfig(t *testing.T) {
 				Key:     guardianPub,
 				Address: "vuvuzela.io",
 			},
+			IntrosPerRound: 4,
+			NumMailboxes:   10,
+			PKGWait:        10 * time.Second,
+			MixWait:        30 * time.Second,
 		},
 	}
 	sig := ed25519.Sign(guardianPriv, conf.SigningMessage())
@@ -258,6 +262,10 @@ func TestMarshalDialingConfig(t *testing.T) {
 				Key:     guardianPub,
 				Address: "localhost:8888",
 			},
+			CallsPerRound: 3,
+			Intents:       5,
+			NumMailboxes:  4,
+			MixWait:       5 * time.Second,
 		},
 	}
 	sig := ed25519.Sign(guardianPriv, conf.SigningMessage())
@@ -287,6 +295,59 @@ func TestMarshalDialingConfig(t *testing.T) {
 	}
 }
 
+func TestAddFriendConfigLimits(t *testing.T) {
+	key, _, _ := ed25519.GenerateKey(rand.Reader)
+	valid := AddFriendConfig{
+		Version: AddFriendConfigVersion,
+		Coordinator: CoordinatorConfig{
+			Key:     key,
+			Address: "localhost:8080",
+		},
+		CDNServer: CDNServerConfig{
+			Key:     key,
+			Address: "localhost:8888",
+		},
+		IntrosPerRound: MaxIntrosPerRound,
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := valid
+	conf.IntrosPerRound = MaxIntrosPerRound + 1
+	if err := conf.Validate(); err == nil {
+		t.Fatalf("accepted %d intros per round", conf.IntrosPerRound)
+	}
+}
+
+func TestDialingConfigLimits(t *testing.T) {
+	key, _, _ := ed25519.GenerateKey(rand.Reader)
+	valid := DialingConfig{
+		Version: DialingConfigVersion,
+		Coordinator: CoordinatorConfig{
+			Key:     key,
+			Address: "localhost:8080",
+		},
+		CallsPerRound: MaxCallsPerRound,
+		Intents:       MaxIntents,
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := valid
+	conf.Intents = MaxIntents + 1
+	if err := conf.Validate(); err == nil {
+		t.Fatalf("accepted %d intents", conf.Intents)
+	}
+
+	conf = valid
+	conf.CallsPerRound = MaxCallsPerRound + 1
+	if err := conf.Validate(); err == nil {
+		t.Fatalf("accepted %d calls per round", conf.CallsPerRound)
+	}
+}
+
 const exampleConfig = `
 {
   "Version": 1,
@@ -168,4 +168,17 @@ func TestServer(t *testing.T) {
 			t.Fatal("wrong config in chain")
 		}
 	}
+
+	// Verified chains are remembered, so this works without the server.
+	client.ConfigServerURL = "http://localhost:0"
+	{
+		chain, err := client.FetchAndVerifyChain(startingConfig, newConfig.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(chain) != 2 || chain[0].Hash() != newConfig.Hash() {
+			t.Fatal("wrong cached chain")
+		}
+	}
 }
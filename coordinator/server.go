@@ -7,9 +7,11 @@ package coordinator
 
 import (
 	"crypto/ed25519"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -42,6 +44,9 @@ type Server struct {
 
 	ConfigClient *config.Client
 
+	// PKGWait, MixWait, and NumMailboxes are used for rounds whose
+	// config doesn't set them. Values in the signed config take
+	// precedence because clients check them.
 	PKGWait      time.Duration
 	MixWait      time.Duration
 	RoundWait    time.Duration
@@ -49,24 +54,32 @@ type Server struct {
 
 	PersistPath string
 
+	// HistorySize is the number of past rounds that the server keeps
+	// PKG settings and mailbox URLs for, so that clients that missed a
+	// round can catch up. If zero, DefaultHistorySize is used.
+	HistorySize int
+
 	mu             sync.Mutex
 	round          uint32
 	onions         [][]byte
+	onionLimit     int
+	onionCounts    map[typesocket.Conn]int
 	closed         bool
 	shutdown       chan struct{}
 	latestMixRound *MixRound
 	latestPKGRound *PKGRound
+	pkgHistory     []*PKGRound
+	mailboxHistory []MailboxURL
 
 	hub *typesocket.Hub
 
 	mixnetClient *mixnet.Client
 	pkgClient    *pkg.CoordinatorClient
 	cdnClient    *edhttp.Client
-
-	// TODO we should keep old PKGSettings and old mailbox URLS around
-	// in case clients request them.
 }
 
+const DefaultHistorySize = 64
+
 var ErrServerClosed = errors.New("coordinator: server closed")
 
 func (srv *Server) Run() error {
@@ -100,6 +113,7 @@ func (srv *Server) Run() error {
 
 	srv.mu.Lock()
 	srv.onions = make([][]byte, 0, 128)
+	srv.onionCounts = make(map[typesocket.Conn]int)
 	srv.closed = false
 	srv.shutdown = make(chan struct{})
 	srv.mu.Unlock()
@@ -127,6 +141,8 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch {
 	case strings.HasPrefix(r.URL.Path, "/ws"):
 		srv.hub.ServeHTTP(w, r)
+	case r.URL.Path == "/history":
+		srv.historyHandler(w, r)
 	default:
 		http.Error(w, "not found", http.StatusNotFound)
 	}
@@ -162,6 +178,56 @@ type MailboxURL struct {
 	Round        uint32
 	URL          string
 	NumMailboxes uint32
+
+	// ConfigHash is the hash of the config the round ran with, so
+	// clients catching up on the round can check which config to use.
+	ConfigHash string
+}
+
+// History is the server's record of recent rounds. Clients fetch it from
+// /history when they reconnect to scan mailboxes they missed.
+type History struct {
+	PKGRounds []*PKGRound
+	Mailboxes []MailboxURL
+}
+
+func (srv *Server) historyHandler(w http.ResponseWriter, r *http.Request) {
+	var since uint32
+	if s := r.URL.Query().Get("since"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			http.Error(w, "invalid since parameter", http.StatusBadRequest)
+			return
+		}
+		since = uint32(n)
+	}
+
+	history := new(History)
+	srv.mu.Lock()
+	for _, pkgRound := range srv.pkgHistory {
+		if pkgRound.Round > since {
+			history.PKGRounds = append(history.PKGRounds, pkgRound)
+		}
+	}
+	for _, mailbox := range srv.mailboxHistory {
+		if mailbox.Round > since {
+			history.Mailboxes = append(history.Mailboxes, mailbox)
+		}
+	}
+	srv.mu.Unlock()
+
+	data, err := json.Marshal(history)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(data)
+}
+
+func (srv *Server) historySize() int {
+	if srv.HistorySize > 0 {
+		return srv.HistorySize
+	}
+	return DefaultHistorySize
 }
 
 func (srv *Server) onConnect(c typesocket.Conn) error {
@@ -187,10 +253,27 @@ func (srv *Server) onConnect(c typesocket.Conn) error {
 func (srv *Server) incomingOnion(c typesocket.Conn, o OnionMsg) {
 	srv.mu.Lock()
 	round := srv.round
+	overLimit := false
 	if o.Round == round {
-		srv.onions = append(srv.onions, o.Onion)
+		// Every client sends the same number of onions per round,
+		// so extra onions can only come from a misbehaving client.
+		if srv.onionLimit > 0 && srv.onionCounts[c] >= srv.onionLimit {
+			overLimit = true
+		} else {
+			srv.onionCounts[c]++
+			srv.onions = append(srv.onions, o.Onion)
+		}
 	}
+	limit := srv.onionLimit
 	srv.mu.Unlock()
+	if overLimit {
+		log.Errorf("round %d: too many onions from one client (limit %d)", round, limit)
+		c.Send("error", RoundError{
+			Round: o.Round,
+			Err:   fmt.Sprintf("too many onions (limit %d)", limit),
+		})
+		return
+	}
 	if o.Round != round {
 		log.Errorf("got onion for wrong round (want %d, got %d)", round, o.Round)
 		c.Send("error", RoundError{
@@ -235,25 +318,48 @@ func (srv *Server) loop() {
 		var mixServers []mixnet.PublicServerConfig
 		var cdnServer config.CDNServerConfig
 		var pkgServers []pkg.PublicServerConfig
+		var onionLimit int
+		numMailboxes := srv.NumMailboxes
+		pkgWait := srv.PKGWait
+		mixWait := srv.MixWait
 		switch srv.Service {
 		case "AddFriend":
 			conf := currentConfig.Inner.(*config.AddFriendConfig)
 			mixServers = conf.MixServers
 			cdnServer = conf.CDNServer
 			pkgServers = conf.PKGServers
+			onionLimit = conf.NumIntros()
+			if conf.NumMailboxes != 0 {
+				numMailboxes = conf.NumMailboxes
+			}
+			if conf.PKGWait != 0 {
+				pkgWait = conf.PKGWait
+			}
+			if conf.MixWait != 0 {
+				mixWait = conf.MixWait
+			}
 			rawServiceData = addfriend.ServiceData{
-				CDNKey:       cdnServer.Key,
-				CDNAddress:   cdnServer.Address,
-				NumMailboxes: srv.NumMailboxes,
+				CDNKey:         cdnServer.Key,
+				CDNAddress:     cdnServer.Address,
+				NumMailboxes:   numMailboxes,
+				IntrosPerRound: uint32(onionLimit),
 			}.Marshal()
 		case "Dialing":
 			conf := currentConfig.Inner.(*config.DialingConfig)
 			mixServers = conf.MixServers
 			cdnServer = conf.CDNServer
+			onionLimit = conf.NumCalls()
+			if conf.NumMailboxes != 0 {
+				numMailboxes = conf.NumMailboxes
+			}
+			if conf.MixWait != 0 {
+				mixWait = conf.MixWait
+			}
 			rawServiceData = dialing.ServiceData{
-				CDNKey:       cdnServer.Key,
-				CDNAddress:   cdnServer.Address,
-				NumMailboxes: srv.NumMailboxes,
+				CDNKey:        cdnServer.Key,
+				CDNAddress:    cdnServer.Address,
+				NumMailboxes:  numMailboxes,
+				CallsPerRound: uint32(onionLimit),
 			}.Marshal()
 		default:
 			log.Panicf("invalid service type: %q", srv.Service)
@@ -262,6 +368,8 @@ func (srv *Server) loop() {
 		srv.mu.Lock()
 		srv.round++
 		round := srv.round
+		srv.onionLimit = onionLimit
+		srv.onionCounts = make(map[typesocket.Conn]int)
 
 		logger := srv.Log.WithFields(log.Fields{"round": round, "config": configHash})
 
@@ -301,11 +409,15 @@ func (srv *Server) loop() {
 			}
 			srv.mu.Lock()
 			srv.latestPKGRound = pkgRound
+			srv.pkgHistory = append(srv.pkgHistory, pkgRound)
+			if n := len(srv.pkgHistory) - srv.historySize(); n > 0 {
+				srv.pkgHistory = srv.pkgHistory[n:]
+			}
 			srv.mu.Unlock()
 
 			srv.hub.Broadcast("pkg", pkgRound)
 
-			if !srv.sleep(srv.PKGWait) {
+			if !srv.sleep(pkgWait) {
 				break
 			}
 		}
@@ -330,7 +442,7 @@ func (srv *Server) loop() {
 			continue
 		}
 
-		roundEnd := time.Now().Add(srv.MixWait)
+		roundEnd := time.Now().Add(mixWait)
 		mixRound := &MixRound{
 			MixSettings:   mixSettings,
 			MixSignatures: mixSigs,
@@ -340,15 +452,15 @@ func (srv *Server) loop() {
 		srv.latestMixRound = mixRound
 		srv.mu.Unlock()
 
-		logger.WithFields(log.Fields{"wait": srv.MixWait}).Info("Announcing mixnet settings")
+		logger.WithFields(log.Fields{"wait": mixWait}).Info("Announcing mixnet settings")
 		srv.hub.Broadcast("mix", mixRound)
 
-		if !srv.sleep(srv.MixWait) {
+		if !srv.sleep(mixWait) {
 			break
 		}
 
 		srv.mu.Lock()
-		go srv.runRound(context.Background(), mixServers[0], round, srv.onions)
+		go srv.runRound(context.Background(), mixServers[0], round, configHash, numMailboxes, srv.onions)
 		srv.onions = make([][]byte, 0, len(srv.onions))
 		srv.mu.Unlock()
 
@@ -371,7 +483,7 @@ func (srv *Server) sleep(d time.Duration) bool {
 	}
 }
 
-func (srv *Server) runRound(ctx context.Context, firstServer mixnet.PublicServerConfig, round uint32, onions [][]byte) {
+func (srv *Server) runRound(ctx context.Context, firstServer mixnet.PublicServerConfig, round uint32, configHash string, numMailboxes uint32, onions [][]byte) {
 	srv.Log.WithFields(log.Fields{
 		"round":  round,
 		"onions": len(onions),
@@ -395,9 +507,18 @@ func (srv *Server) runRound(ctx context.Context, firstServer mixnet.PublicServer
 		"duration": end.Sub(start),
 	}).Info("End mixing")
 
-	srv.hub.Broadcast("mailbox", MailboxURL{
+	mailbox := MailboxURL{
 		Round:        round,
 		URL:          url,
-		NumMailboxes: srv.NumMailboxes,
-	})
+		NumMailboxes: numMailboxes,
+		ConfigHash:   configHash,
+	}
+	srv.mu.Lock()
+	srv.mailboxHistory = append(srv.mailboxHistory, mailbox)
+	if n := len(srv.mailboxHistory) - srv.historySize(); n > 0 {
+		srv.mailboxHistory = srv.mailboxHistory[n:]
+	}
+	srv.mu.Unlock()
+
+	srv.hub.Broadcast("mailbox", mailbox)
 }
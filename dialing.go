@@ -5,12 +5,13 @@
 package alpenhorn
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"sync/atomic"
+	"time"
 
 	"github.com/davidlazar/go-crypto/encoding/base32"
 
-	"alpenhorn/addfriend"
 	"alpenhorn/bloom"
 	"alpenhorn/config"
 	"alpenhorn/coordinator"
@@ -29,6 +30,16 @@ type dialingRoundState struct {
 	ConfigParent *config.SignedConfig
 }
 
+// pruneDialingRoundsLocked deletes the state of rounds that are too old to
+// finish, as of the given round.
+func (c *Client) pruneDialingRoundsLocked(round uint32) {
+	for r := range c.dialingRounds {
+		if r+roundRetention < round {
+			delete(c.dialingRounds, r)
+		}
+	}
+}
+
 func (c *Client) dialingMux() typesocket.Mux {
 	return typesocket.NewMux(map[string]interface{}{
 		"newround": c.newDialingRound,
@@ -43,9 +54,19 @@ func (c *Client) dialingRoundError(conn typesocket.Conn, v coordinator.RoundErro
 }
 
 func (c *Client) newDialingRound(conn typesocket.Conn, v coordinator.NewRound) {
+	// persistErr is reported after c.mu is unlocked.
+	var persistErr error
+	defer func() {
+		if persistErr != nil {
+			c.Handler.Error(persistErr)
+		}
+	}()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	c.pruneDialingRoundsLocked(v.Round)
+
 	st, ok := c.dialingRounds[v.Round]
 	if ok {
 		if st.ConfigParent.Hash() != v.ConfigHash {
@@ -75,9 +96,10 @@ func (c *Client) newDialingRound(conn typesocket.Conn, v coordinator.NewRound) {
 	newConfig := configs[0]
 	c.dialingConfig = newConfig
 	c.dialingConfigHash = v.ConfigHash
+	c.followCoordinatorLocked("Dialing", newConfig.Inner.(*config.DialingConfig).Coordinator)
 
 	if err := c.persistLocked(); err != nil {
-		panic("failed to persist state: " + err.Error())
+		persistErr = c.persistFailedLocked(err)
 	}
 
 	c.dialingRounds[v.Round] = &dialingRoundState{
@@ -98,9 +120,13 @@ func (c *Client) sendDialingOnion(conn typesocket.Conn, v coordinator.MixRound)
 		return
 	}
 
-	serviceData := new(addfriend.ServiceData)
+	serviceData := new(dialing.ServiceData)
 	if err := serviceData.Unmarshal(v.MixSettings.RawServiceData); err != nil {
-		c.Handler.Error(errors.New("sendAddFriendOnion: round %d: error parsing service data: %s", round, err))
+		c.Handler.Error(errors.New("sendDialingOnion: round %d: error parsing service data: %s", round, err))
+		return
+	}
+	if err := checkDialingServiceData(st.Config, serviceData); err != nil {
+		c.Handler.Error(errors.Wrap(err, "sendDialingOnion: round %d", round))
 		return
 	}
 	settingsMsg := v.MixSettings.SigningMessage()
@@ -116,35 +142,103 @@ func (c *Client) sendDialingOnion(conn typesocket.Conn, v coordinator.MixRound)
 		}
 	}
 
+	// Don't take calls off the queue for a coordinator we left.
+	if !c.isCurrentConn("Dialing", conn) {
+		return
+	}
+
 	atomic.StoreUint32(&c.lastDialingRound, round)
 
-	mixMessage := new(dialing.MixMessage)
-	call := c.nextOutgoingCall(round)
-	// TODO timing leak
-	if call != nil {
-		c.mu.Lock()
-		call.sentRound = round
-		c.mu.Unlock()
+	// Fill every slot so the number of real calls doesn't leak.
+	numCalls := st.Config.NumCalls()
+	numIntents := st.Config.NumIntents()
+	calls := make([]*OutgoingCall, numCalls)
+	onions := make([][]byte, numCalls)
+	for i := range onions {
+		mixMessage := new(dialing.MixMessage)
+		call := c.nextOutgoingCall(round)
+		if call != nil && call.Intent() >= numIntents {
+			// The config changed after the call was queued.
+			c.Handler.Error(errors.New("round %d: dropping call to %s: intent %d is not valid in the current config",
+				round, call.Username, call.Intent()))
+			call = nil
+		}
+		// TODO timing leak
+		if call != nil {
+			c.mu.Lock()
+			call.sentRound = round
+			c.mu.Unlock()
+
+			token := call.computeKeys().token
+			copy(mixMessage.Token[:], token[:])
+			mixMessage.Mailbox = usernameToMailbox(call.Username, serviceData.NumMailboxes)
+		} else {
+			// Send cover traffic.
+			mixMessage.Mailbox = 0
+		}
 
-		// Let the application know we're sending the call.
-		c.Handler.SendingCall(call)
+		calls[i] = call
+		onions[i], _ = onionbox.Seal(mustMarshal(mixMessage), mixnet.ForwardNonce(round), v.MixSettings.OnionKeys)
+	}
 
-		token := call.computeKeys().token
-		copy(mixMessage.Token[:], token[:])
-		mixMessage.Mailbox = usernameToMailbox(call.Username, serviceData.NumMailboxes)
-	} else {
-		// Send cover traffic.
-		mixMessage.Mailbox = 0
+	for i, onion := range onions {
+		// respond to the entry server with our onion for this round
+		omsg := coordinator.OnionMsg{
+			Round: round,
+			Onion: onion,
+		}
+		if err := conn.Send("onion", omsg); err != nil {
+			// Put the unsent calls back so they're sent in a later round.
+			var unsent []*OutgoingCall
+			c.mu.Lock()
+			for _, call := range calls[i:] {
+				if call != nil {
+					call.sentRound = 0
+					call.dialToken = nil
+					call.sessionKey = nil
+					unsent = append(unsent, call)
+				}
+			}
+			c.outgoingCalls = append(unsent, c.outgoingCalls...)
+			c.mu.Unlock()
+			c.Handler.Error(errors.Wrap(err, "round %d: sending onion", round))
+			calls = calls[:i]
+			break
+		}
 	}
 
-	onion, _ := onionbox.Seal(mustMarshal(mixMessage), mixnet.ForwardNonce(round), v.MixSettings.OnionKeys)
+	for _, call := range calls {
+		if call == nil {
+			continue
+		}
+		// Let the application know we sent the call.
+		c.Handler.SendingCall(call)
+		c.logCall(CallRecord{
+			Username: call.Username,
+			Round:    round,
+			Intent:   call.Intent(),
+			Outgoing: true,
+			Time:     time.Now(),
+		})
+	}
+}
 
-	// respond to the entry server with our onion for this round
-	omsg := coordinator.OnionMsg{
-		Round: round,
-		Onion: onion,
+// checkDialingServiceData is like checkAddFriendServiceData.
+func checkDialingServiceData(conf *config.DialingConfig, data *dialing.ServiceData) error {
+	if !bytes.Equal(data.CDNKey, conf.CDNServer.Key) || data.CDNAddress != conf.CDNServer.Address {
+		return errors.New("service data has CDN %s, config has %s", data.CDNAddress, conf.CDNServer.Address)
+	}
+	if conf.NumMailboxes != 0 && data.NumMailboxes != conf.NumMailboxes {
+		return errors.New("service data has %d mailboxes, config has %d", data.NumMailboxes, conf.NumMailboxes)
 	}
-	conn.Send("onion", omsg)
+	calls := int(data.CallsPerRound)
+	if calls == 0 {
+		calls = 1
+	}
+	if calls != conf.NumCalls() {
+		return errors.New("service data has %d calls per round, config has %d", calls, conf.NumCalls())
+	}
+	return nil
 }
 
 func (c *Client) nextOutgoingCall(round uint32) *OutgoingCall {
@@ -155,18 +249,30 @@ func (c *Client) nextOutgoingCall(round uint32) *OutgoingCall {
 	if len(c.outgoingCalls) > 0 {
 		call = c.outgoingCalls[0]
 		c.outgoingCalls = c.outgoingCalls[1:]
+	} else {
+		call = c.nextScheduledCallLocked(round)
 	}
 
 	return call
 }
 
 func (c *Client) scanBloomFilter(conn typesocket.Conn, v coordinator.MailboxURL) {
+	if conn != nil && c.waitForCatchUp("Dialing", v.Round) {
+		return
+	}
+
 	c.mu.Lock()
 	st, ok := c.dialingRounds[v.Round]
 	c.mu.Unlock()
 	if !ok {
 		return
 	}
+	if n := st.Config.NumMailboxes; n != 0 && v.NumMailboxes != n {
+		c.Handler.Error(errors.New("scanBloomFilter: round %d: coordinator announced %d mailboxes, config has %d", v.Round, v.NumMailboxes, n))
+		// The round's keys must still be erased.
+		c.finishDialingRound(st)
+		return
+	}
 
 	mailboxID := usernameToMailbox(c.Username, v.NumMailboxes)
 	mailbox, err := c.fetchMailbox(st.Config.CDNServer, v.URL, mailboxID)
@@ -180,7 +286,7 @@ func (c *Client) scanBloomFilter(conn typesocket.Conn, v coordinator.MailboxURL)
 		c.Handler.Error(errors.Wrap(err, "decoding bloom filter"))
 	}
 
-	allTokens := c.wheel.IncomingDialTokens(c.Username, v.Round, IntentMax)
+	allTokens := c.wheel.IncomingDialTokens(c.Username, v.Round, st.Config.NumIntents())
 	for _, user := range allTokens {
 		for intent, token := range user.Tokens {
 			if filter.Test(token[:]) {
@@ -188,13 +294,47 @@ func (c *Client) scanBloomFilter(conn typesocket.Conn, v coordinator.MailboxURL)
 					Username:   user.FromUsername,
 					Intent:     intent,
 					SessionKey: c.wheel.SessionKey(user.FromUsername, v.Round),
+
+					callee: c.Username,
+					round:  v.Round,
 				}
 				c.Handler.ReceivedCall(call)
+				c.logCall(CallRecord{
+					Username: call.Username,
+					Round:    v.Round,
+					Intent:   intent,
+					Missed:   conn == nil,
+					Time:     time.Now(),
+				})
 			}
 		}
 	}
-	c.wheel.EraseKeys(v.Round)
-	if err := c.persistKeywheel(); err != nil {
-		panic(err)
+	c.finishDialingRound(st)
+}
+
+// finishDialingRound erases the round's keys from the keywheel and
+// deletes the round's state. This is the last step of the round.
+func (c *Client) finishDialingRound(st *dialingRoundState) {
+	c.wheel.EraseKeys(st.Round)
+
+	c.mu.Lock()
+	if c.dialingRounds[st.Round] == st {
+		delete(c.dialingRounds, st.Round)
+	}
+	if st.Round > c.lastDialingMailbox {
+		c.lastDialingMailbox = st.Round
+	}
+	// The client state is persisted with the keywheel so that
+	// lastDialingMailbox never lags behind the erased keys, and the
+	// call log is always persisted to avoid side-channels.
+	err := c.persistLocked()
+	logErr := c.persistCallLogLocked()
+	c.mu.Unlock()
+
+	if err != nil {
+		c.persistFailed(err)
+	}
+	if logErr != nil {
+		c.Handler.Error(errors.Wrap(logErr, "persisting call log"))
 	}
 }
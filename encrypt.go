@@ -0,0 +1,199 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"bytes"
+	"crypto/rand"
+
+	"alpenhorn/errors"
+	"alpenhorn/internal/passbox"
+)
+
+// Encrypted client state and keywheel files start with encryptedMagic,
+// followed by a 32-byte scrypt salt and a passbox ciphertext of the
+// plaintext file. The salt is all zeros if the key was supplied by the
+// application instead of derived from a passphrase.
+const encryptedMagic = "alpenhorn-encrypted-v1\n"
+
+const sizeSalt = 32
+
+var (
+	// ErrEncrypted is returned by LoadClient when the client's files
+	// are encrypted. Use LoadClientWithPassphrase or LoadClientWithKey.
+	ErrEncrypted = errors.New("client state is encrypted")
+
+	// ErrWrongPassphrase is returned when an encrypted file cannot be
+	// decrypted with the given passphrase or key.
+	ErrWrongPassphrase = errors.New("wrong passphrase or key")
+
+	// ErrNotEncrypted is returned when one of the client's files is
+	// encrypted and another is not.
+	ErrNotEncrypted = errors.New("client file is not encrypted")
+)
+
+// stateKey is the key used to encrypt the client's files at rest.
+type stateKey struct {
+	key  *[32]byte
+	salt [sizeSalt]byte
+}
+
+// unlocker returns the key for a file, given the salt stored in the file.
+type unlocker func(salt [sizeSalt]byte) *stateKey
+
+func passphraseUnlocker(passphrase []byte) unlocker {
+	var derived []*stateKey
+	return func(salt [sizeSalt]byte) *stateKey {
+		// The client state and keywheel are usually encrypted with the same
+		// salt, so avoid running scrypt twice.
+		for _, k := range derived {
+			if k.salt == salt {
+				return k
+			}
+		}
+		k := &stateKey{
+			key:  passbox.DeriveKey(passphrase, salt[:]),
+			salt: salt,
+		}
+		derived = append(derived, k)
+		return k
+	}
+}
+
+func keyUnlocker(key *[32]byte) unlocker {
+	return func(salt [sizeSalt]byte) *stateKey {
+		return &stateKey{key: key, salt: salt}
+	}
+}
+
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedMagic))
+}
+
+func (k *stateKey) seal(data []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString(encryptedMagic)
+	buf.Write(k.salt[:])
+	buf.Write(passbox.Seal(data, k.key))
+	return buf.Bytes()
+}
+
+// openFile returns the plaintext of a persisted file and the key that
+// decrypted it, or a nil key if the file is not encrypted. If encrypted
+// is true, openFile rejects unencrypted data: once one of the client's
+// files is encrypted, the others must be too, so that someone with
+// access to the disk can't swap in a plaintext file.
+func openFile(data []byte, unlock unlocker, encrypted bool) ([]byte, *stateKey, error) {
+	if !isEncrypted(data) {
+		if encrypted {
+			return nil, nil, ErrNotEncrypted
+		}
+		return data, nil, nil
+	}
+	if unlock == nil {
+		return nil, nil, ErrEncrypted
+	}
+
+	data = data[len(encryptedMagic):]
+	if len(data) < sizeSalt {
+		return nil, nil, errors.New("encrypted file too short")
+	}
+	var salt [sizeSalt]byte
+	copy(salt[:], data[:sizeSalt])
+
+	k := unlock(salt)
+	msg, ok := passbox.Open(data[sizeSalt:], k.key)
+	if !ok {
+		return nil, nil, ErrWrongPassphrase
+	}
+	return msg, k, nil
+}
+
+// LoadClientWithPassphrase is like LoadClient but decrypts the client
+// state and keywheel with the given passphrase. The client continues
+// to encrypt its files with the passphrase.
+func LoadClientWithPassphrase(clientPersistPath, keywheelPersistPath string, passphrase []byte) (*Client, error) {
+	return loadClientFiles(clientPersistPath, keywheelPersistPath, passphraseUnlocker(passphrase))
+}
+
+// LoadClientWithKey is like LoadClientWithPassphrase but uses a key
+// supplied by the application, such as a key from the platform's
+// keychain, instead of a passphrase.
+func LoadClientWithKey(clientPersistPath, keywheelPersistPath string, key *[32]byte) (*Client, error) {
+	return loadClientFiles(clientPersistPath, keywheelPersistPath, keyUnlocker(key))
+}
+
+// LoadClientFromStoreWithPassphrase is like LoadClientWithPassphrase
+// but loads the client from store.
+func LoadClientFromStoreWithPassphrase(store StateStore, passphrase []byte) (*Client, error) {
+	return loadClientFromStore(store, passphraseUnlocker(passphrase))
+}
+
+// LoadClientFromStoreWithKey is like LoadClientWithKey but loads the
+// client from store.
+func LoadClientFromStoreWithKey(store StateStore, key *[32]byte) (*Client, error) {
+	return loadClientFromStore(store, keyUnlocker(key))
+}
+
+// SetPassphrase encrypts the client's state and keywheel files with
+// a key derived from passphrase, replacing any previous passphrase or
+// key, and persists the client. A nil passphrase turns off encryption.
+// If the client's files can't all be rewritten, the client goes back to
+// its previous passphrase or key and SetPassphrase returns the error.
+func (c *Client) SetPassphrase(passphrase []byte) error {
+	var k *stateKey
+	if passphrase != nil {
+		k = new(stateKey)
+		if _, err := rand.Read(k.salt[:]); err != nil {
+			return err
+		}
+		k.key = passbox.DeriveKey(passphrase, k.salt[:])
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.setPersistKeyLocked(k)
+}
+
+// SetPersistKey is like SetPassphrase but uses a key supplied by the
+// application. A nil key turns off encryption.
+func (c *Client) SetPersistKey(key *[32]byte) error {
+	var k *stateKey
+	if key != nil {
+		k = &stateKey{key: key}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.setPersistKeyLocked(k)
+}
+
+func (c *Client) setPersistKeyLocked(k *stateKey) error {
+	// Read the call log with the old key before it is replaced.
+	if err := c.loadCallLogLocked(); err != nil {
+		return err
+	}
+	old := c.persistKey
+	c.persistKey = k
+	err := c.persistLocked()
+	if err == nil {
+		err = c.persistCallLogLocked()
+	}
+	if err == nil {
+		return nil
+	}
+
+	// Some files may already be encrypted with the new key. Rewrite them
+	// with the old key so that one passphrase or key still opens them all.
+	c.persistKey = old
+	rollbackErr := c.persistLocked()
+	if rollbackErr == nil {
+		rollbackErr = c.persistCallLogLocked()
+	}
+	if rollbackErr != nil {
+		return errors.Wrap(err, "changing key (and restoring the old key failed: %s)", rollbackErr)
+	}
+	return errors.Wrap(err, "changing key")
+}
@@ -0,0 +1,339 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"crypto/ed25519"
+	"sync"
+
+	"alpenhorn/config"
+	"alpenhorn/errors"
+)
+
+// An Event is something the client reports to the application. It is one
+// of ErrorEvent, ConfirmedFriendEvent, SentFriendRequestEvent,
+// ReceivedFriendRequestEvent, FriendRequestExpiredEvent,
+// UnexpectedSigningKeyEvent, FriendKeyChangedEvent, FriendRekeyedEvent,
+// SendingCallEvent, ReceivedCallEvent, NewConfigEvent, or
+// ConnectionEvent. Each corresponds to the handler method with the same
+// name, in EventHandler or one of the optional handler interfaces.
+type Event interface {
+	isEvent()
+}
+
+type ErrorEvent struct {
+	Err error
+}
+
+type ConfirmedFriendEvent struct {
+	Friend *Friend
+}
+
+type SentFriendRequestEvent struct {
+	Request *OutgoingFriendRequest
+}
+
+type ReceivedFriendRequestEvent struct {
+	Request *IncomingFriendRequest
+}
+
+// FriendRequestExpiredEvent has exactly one non-nil field.
+type FriendRequestExpiredEvent struct {
+	Incoming *IncomingFriendRequest
+	Outgoing *OutgoingFriendRequest
+}
+
+type UnexpectedSigningKeyEvent struct {
+	Incoming *IncomingFriendRequest
+	Outgoing *OutgoingFriendRequest
+}
+
+type FriendKeyChangedEvent struct {
+	Friend *Friend
+	OldKey ed25519.PublicKey
+}
+
+type FriendRekeyedEvent struct {
+	Friend *Friend
+}
+
+type SendingCallEvent struct {
+	Call *OutgoingCall
+}
+
+type ReceivedCallEvent struct {
+	Call *IncomingCall
+}
+
+type NewConfigEvent struct {
+	Chain []*config.SignedConfig
+}
+
+func (ErrorEvent) isEvent()                 {}
+func (ConfirmedFriendEvent) isEvent()       {}
+func (SentFriendRequestEvent) isEvent()     {}
+func (ReceivedFriendRequestEvent) isEvent() {}
+func (FriendRequestExpiredEvent) isEvent()  {}
+func (UnexpectedSigningKeyEvent) isEvent()  {}
+func (FriendKeyChangedEvent) isEvent()      {}
+func (FriendRekeyedEvent) isEvent()         {}
+func (SendingCallEvent) isEvent()           {}
+func (ReceivedCallEvent) isEvent()          {}
+func (NewConfigEvent) isEvent()             {}
+func (ConnectionEvent) isEvent()            {}
+
+// Dispatch calls the EventHandler method that corresponds to e. It lets
+// applications written against EventHandler consume an EventStream.
+// Events for optional interfaces, such as ConnectionStateHandler, are
+// dropped if h does not implement them, except that a FriendRekeyedEvent
+// is passed to ConfirmedFriend, as the client would.
+func Dispatch(h EventHandler, e Event) {
+	switch e := e.(type) {
+	case ErrorEvent:
+		h.Error(e.Err)
+	case ConfirmedFriendEvent:
+		h.ConfirmedFriend(e.Friend)
+	case SentFriendRequestEvent:
+		h.SentFriendRequest(e.Request)
+	case ReceivedFriendRequestEvent:
+		h.ReceivedFriendRequest(e.Request)
+	case FriendRequestExpiredEvent:
+		if h, ok := h.(FriendRequestExpiredHandler); ok {
+			h.FriendRequestExpired(e.Incoming, e.Outgoing)
+		}
+	case UnexpectedSigningKeyEvent:
+		h.UnexpectedSigningKey(e.Incoming, e.Outgoing)
+	case FriendKeyChangedEvent:
+		if h, ok := h.(FriendKeyChangedHandler); ok {
+			h.FriendKeyChanged(e.Friend, e.OldKey)
+		}
+	case FriendRekeyedEvent:
+		if rh, ok := h.(FriendRekeyedHandler); ok {
+			rh.FriendRekeyed(e.Friend)
+		} else {
+			h.ConfirmedFriend(e.Friend)
+		}
+	case SendingCallEvent:
+		h.SendingCall(e.Call)
+	case ReceivedCallEvent:
+		h.ReceivedCall(e.Call)
+	case NewConfigEvent:
+		h.NewConfig(e.Chain)
+	case ConnectionEvent:
+		if h, ok := h.(ConnectionStateHandler); ok {
+			h.ConnectionStateChanged(e)
+		}
+	}
+}
+
+// An EventStream is an EventHandler that delivers events over a channel
+// instead of calling into the application. Set a client's Handler to an
+// EventStream and receive from Events.
+//
+// The client calls its handler from inside the protocol's round handlers,
+// so an EventStream never blocks. If the application falls behind and the
+// stream's buffer is full, SendingCallEvents and ReceivedCallEvents wait
+// in a queue until there is room, since a call's session key is reported
+// only once. Other events are dropped and counted by Dropped. Friends and
+// friend requests in dropped events are still available from the client,
+// through GetFriends and GetIncomingFriendRequests for example, but dropped
+// ErrorEvents, NewConfigEvents, and ConnectionEvents are lost.
+//
+// The queue holds at most MaxQueuedCalls events, so an application that
+// stops receiving doesn't hold on to memory and session keys forever.
+// Calls that don't fit are dropped too, and the stream reports the loss
+// with an ErrorEvent for ErrCallsDropped after the queued calls.
+//
+// Events that the client reports from a single goroutine are delivered
+// in the order they were reported. In particular, a service's connection
+// events are in order, and events caused by one another (such as a
+// SentFriendRequestEvent and the ConfirmedFriendEvent for that request)
+// arrive in causal order. Events from different rounds or services may be
+// interleaved.
+type EventStream struct {
+	mu      sync.Mutex
+	events  chan Event
+	dropped uint64
+	closed  bool
+
+	// queue holds call events that did not fit in the buffer. While it
+	// is not empty, pump delivers its events and other events are dropped
+	// so they don't overtake the queued calls. overflowed is set when
+	// ErrCallsDropped has been queued, until the queue drains.
+	queue      []Event
+	maxQueue   int
+	overflowed bool
+	pumping    bool
+	done       chan struct{}
+	pumpWG     sync.WaitGroup
+}
+
+// MaxQueuedCalls is the number of call events an EventStream queues
+// when its buffer is full.
+const MaxQueuedCalls = 1024
+
+// ErrCallsDropped is reported in an ErrorEvent when an EventStream drops
+// call events because its queue is full.
+var ErrCallsDropped = errors.New("event stream queue is full: dropped call events")
+
+// NewEventStream returns an EventStream that buffers up to size events.
+func NewEventStream(size int) *EventStream {
+	return &EventStream{
+		events:   make(chan Event, size),
+		maxQueue: MaxQueuedCalls,
+		done:     make(chan struct{}),
+	}
+}
+
+// Events returns the channel that events are delivered on. The channel
+// is closed by Close.
+func (s *EventStream) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped returns the number of events dropped because the buffer was full.
+func (s *EventStream) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Close closes the events channel. Queued events and events reported
+// after Close are dropped.
+func (s *EventStream) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.dropped += uint64(len(s.queue))
+	s.queue = nil
+	close(s.done)
+	s.mu.Unlock()
+
+	s.pumpWG.Wait()
+	close(s.events)
+}
+
+// send delivers e without blocking. If the buffer is full, e is queued
+// if keep is true and dropped otherwise.
+func (s *EventStream) send(e Event, keep bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		s.dropped++
+		return
+	}
+	if !s.pumping {
+		select {
+		case s.events <- e:
+			return
+		default:
+		}
+	}
+	if !keep {
+		s.dropped++
+		return
+	}
+	if len(s.queue) >= s.maxQueue {
+		s.dropped++
+		if !s.overflowed {
+			// Report the loss in order, after the calls that fit.
+			s.overflowed = true
+			s.queue = append(s.queue, ErrorEvent{Err: ErrCallsDropped})
+		}
+		return
+	}
+
+	s.queue = append(s.queue, e)
+	if !s.pumping {
+		s.pumping = true
+		s.pumpWG.Add(1)
+		go s.pump()
+	}
+}
+
+// pump delivers queued events in order as the application receives them.
+func (s *EventStream) pump() {
+	defer s.pumpWG.Done()
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.pumping = false
+			s.overflowed = false
+			s.mu.Unlock()
+			return
+		}
+		// e stays in the queue until it is delivered, so that it counts
+		// toward maxQueue.
+		e := s.queue[0]
+		s.mu.Unlock()
+
+		select {
+		case s.events <- e:
+			s.mu.Lock()
+			if s.closed {
+				// Close counted e as dropped along with the queue.
+				s.dropped--
+			} else {
+				s.queue[0] = nil
+				s.queue = s.queue[1:]
+			}
+			s.mu.Unlock()
+		case <-s.done:
+			// Close counted e as dropped.
+			return
+		}
+	}
+}
+
+func (s *EventStream) Error(err error) {
+	s.send(ErrorEvent{Err: err}, false)
+}
+
+func (s *EventStream) ConfirmedFriend(f *Friend) {
+	s.send(ConfirmedFriendEvent{Friend: f}, false)
+}
+
+func (s *EventStream) SentFriendRequest(r *OutgoingFriendRequest) {
+	s.send(SentFriendRequestEvent{Request: r}, false)
+}
+
+func (s *EventStream) ReceivedFriendRequest(r *IncomingFriendRequest) {
+	s.send(ReceivedFriendRequestEvent{Request: r}, false)
+}
+
+func (s *EventStream) FriendRequestExpired(in *IncomingFriendRequest, out *OutgoingFriendRequest) {
+	s.send(FriendRequestExpiredEvent{Incoming: in, Outgoing: out}, false)
+}
+
+func (s *EventStream) UnexpectedSigningKey(in *IncomingFriendRequest, out *OutgoingFriendRequest) {
+	s.send(UnexpectedSigningKeyEvent{Incoming: in, Outgoing: out}, false)
+}
+
+func (s *EventStream) FriendKeyChanged(friend *Friend, oldKey ed25519.PublicKey) {
+	s.send(FriendKeyChangedEvent{Friend: friend, OldKey: oldKey}, false)
+}
+
+func (s *EventStream) FriendRekeyed(friend *Friend) {
+	s.send(FriendRekeyedEvent{Friend: friend}, false)
+}
+
+func (s *EventStream) SendingCall(call *OutgoingCall) {
+	s.send(SendingCallEvent{Call: call}, true)
+}
+
+func (s *EventStream) ReceivedCall(call *IncomingCall) {
+	s.send(ReceivedCallEvent{Call: call}, true)
+}
+
+func (s *EventStream) NewConfig(chain []*config.SignedConfig) {
+	s.send(NewConfigEvent{Chain: chain}, false)
+}
+
+func (s *EventStream) ConnectionStateChanged(e ConnectionEvent) {
+	s.send(e, false)
+}
@@ -6,8 +6,10 @@ package alpenhorn
 
 import (
 	"crypto/ed25519"
-	"fmt"
 	"time"
+
+	"alpenhorn/config"
+	"alpenhorn/errors"
 )
 
 // Friend is an entry in the client's address book.
@@ -17,7 +19,9 @@ type Friend struct {
 
 	// extraData stores application-specific data.
 	extraData []byte
-	client    *Client
+	// verified is set by the user after comparing safety numbers.
+	verified bool
+	client   *Client
 }
 
 // GetFriends returns all the friends in the client's address book.
@@ -57,6 +61,14 @@ func (f *Friend) Remove() error {
 	}
 	f.client.outgoingCalls = calls
 
+	scheduled := f.client.scheduledCalls[:0]
+	for _, s := range f.client.scheduledCalls {
+		if s.Username != f.Username {
+			scheduled = append(scheduled, s)
+		}
+	}
+	f.client.scheduledCalls = scheduled
+
 	err := f.client.persistLocked()
 	return err
 }
@@ -87,6 +99,40 @@ func (f *Friend) ExtraData() []byte {
 	return data
 }
 
+// Rekey replaces the keywheel secret shared with the friend, for example
+// after a suspected compromise of the keywheel. It queues a friend request
+// pinned to the friend's long-term key; the friend's client confirms it
+// without asking its user. Calls use the old secret until the exchange
+// completes, when both clients swap in the new secret and report the
+// friend to FriendRekeyed (or ConfirmedFriend if the Handler is not a
+// FriendRekeyedHandler). The friend's extra data and call history are
+// kept.
+func (f *Friend) Rekey() (*OutgoingFriendRequest, error) {
+	c := f.client
+	req := &OutgoingFriendRequest{
+		Username:    f.Username,
+		ExpectedKey: f.LongTermKey,
+		rekey:       true,
+		client:      c,
+	}
+	c.mu.Lock()
+	c.outgoingFriendRequests = append(c.outgoingFriendRequests, req)
+	err := c.persistLocked()
+	c.mu.Unlock()
+	return req, err
+}
+
+// isRekeyRequest returns true if the friend request is from an existing
+// friend with the same long-term key. Only requests that were signed as
+// rekey requests are confirmed automatically.
+func (c *Client) isRekeyRequest(req *IncomingFriendRequest) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	friend := c.friends[req.Username]
+	return friend != nil && friend.LongTermKey.Equal(req.LongTermKey)
+}
+
 // UnsafeKeywheelState exposes the internal keywheel state for this friend.
 // This should only be used for debugging.
 func (f *Friend) UnsafeKeywheelState() (uint32, *[32]byte) {
@@ -99,20 +145,48 @@ func (f *Friend) SessionKey(round uint32) *[32]byte {
 	return f.client.wheel.SessionKey(f.Username, round)
 }
 
-// Intents are the dialing intents passed to Call.
-const IntentMax = 3
+// IntentMax is the number of dialing intents when the dialing config
+// doesn't set one. Use Client.NumIntents for the current number.
+const IntentMax = config.DefaultIntents
+
+// ErrInvalidIntent is returned when an intent is out of range for the
+// current dialing config.
+var ErrInvalidIntent = errors.New("invalid intent")
+
+// NumIntents returns the number of intents allowed by the client's
+// dialing config. Intents passed to Call and CallIntent must be less
+// than this.
+func (c *Client) NumIntents() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.numIntentsLocked()
+}
+
+func (c *Client) numIntentsLocked() int {
+	if c.dialingConfig == nil {
+		return IntentMax
+	}
+	return c.dialingConfig.Inner.(*config.DialingConfig).NumIntents()
+}
 
 // Call is used to call a friend using Alpenhorn's dialing protocol.
 // Call does not send the call right away but queues the call for an
 // upcoming dialing round. The resulting OutgoingCall is the queued
 // call object. Call does nothing and returns nil if the friend is
-// not in the client's address book.
+// not in the client's address book or if the intent is invalid;
+// use CallIntent to find out why.
 func (f *Friend) Call(intent int) *OutgoingCall {
-	if intent >= IntentMax {
-		panic(fmt.Sprintf("invalid intent: %d", intent))
-	}
+	call, _ := f.CallIntent(intent)
+	return call
+}
+
+// CallIntent is like Call but returns an error if the call can't be
+// queued: ErrInvalidIntent if the intent is not less than the client's
+// NumIntents, which can change when the dialing config changes, or
+// another error if the friend is not in the client's address book.
+func (f *Friend) CallIntent(intent int) (*OutgoingCall, error) {
 	if !f.client.wheel.Exists(f.Username) {
-		return nil
+		return nil, errors.New("no keywheel entry for %s", f.Username)
 	}
 
 	call := &OutgoingCall{
@@ -122,15 +196,22 @@ func (f *Friend) Call(intent int) *OutgoingCall {
 		intent:   intent,
 	}
 	f.client.mu.Lock()
+	defer f.client.mu.Unlock()
+	if intent < 0 || intent >= f.client.numIntentsLocked() {
+		return nil, ErrInvalidIntent
+	}
 	f.client.outgoingCalls = append(f.client.outgoingCalls, call)
-	f.client.mu.Unlock()
-	return call
+	return call, nil
 }
 
 type IncomingCall struct {
 	Username   string
 	Intent     int
 	SessionKey *[32]byte
+
+	// callee and round are bound into keys by DeriveKeys.
+	callee string
+	round  uint32
 }
 
 type OutgoingCall struct {
@@ -165,6 +246,9 @@ func (r *OutgoingCall) UpdateIntent(intent int) error {
 	if r.dialToken != nil {
 		return ErrTooLate
 	}
+	if intent < 0 || intent >= r.client.numIntentsLocked() {
+		return ErrInvalidIntent
+	}
 	r.intent = intent
 	return nil
 }
@@ -7,6 +7,7 @@ package alpenhorn
 import (
 	"crypto/ed25519"
 	"errors"
+	"time"
 
 	"alpenhorn/pkg"
 )
@@ -46,6 +47,18 @@ type OutgoingFriendRequest struct {
 	// request is sent.
 	DialRound uint32
 
+	// verified indicates that ExpectedKey was obtained out of band, as
+	// with AcceptInvite. The resulting friend is marked verified if its
+	// key matches ExpectedKey.
+	verified bool
+
+	// inviteSecret is the secret from the invite that the request
+	// accepts, if any.
+	inviteSecret []byte
+
+	// rekey marks a request made by Friend.Rekey.
+	rekey bool
+
 	client *Client
 }
 
@@ -59,9 +72,16 @@ type sentFriendRequest struct {
 	DialRound    uint32
 
 	SentRound    uint32
+	SentTime     time.Time
 	DHPublicKey  *[32]byte
 	DHPrivateKey *[32]byte
 
+	Verified bool `json:",omitempty"`
+
+	// Rekey is true if the request was sent by Friend.Rekey or to
+	// confirm a rekey request.
+	Rekey bool `json:",omitempty"`
+
 	client *Client
 }
 
@@ -104,14 +124,7 @@ func (c *Client) GetSentFriendRequests() []*OutgoingFriendRequest {
 
 	reqs := make([]*OutgoingFriendRequest, len(c.sentFriendRequests))
 	for i, req := range c.sentFriendRequests {
-		reqs[i] = &OutgoingFriendRequest{
-			Username:     req.Username,
-			ExpectedKey:  req.ExpectedKey,
-			Confirmation: req.Confirmation,
-			DialRound:    req.DialRound,
-
-			client: c,
-		}
+		reqs[i] = req.outgoing()
 	}
 	return reqs
 }
@@ -124,6 +137,11 @@ type IncomingFriendRequest struct {
 	DialRound   uint32
 	Verifiers   []pkg.PublicServerConfig
 
+	// ReceivedRound and ReceivedTime are the add-friend round and time
+	// when the client received the friend request.
+	ReceivedRound uint32
+	ReceivedTime  time.Time
+
 	client *Client
 }
 
@@ -132,10 +150,22 @@ type IncomingFriendRequest struct {
 // confirmation request is sent. Approve assumes that the friend request
 // has not been previously rejected.
 func (r *IncomingFriendRequest) Approve() (*OutgoingFriendRequest, error) {
+	return r.approve(false, false)
+}
+
+// approve is Approve; rekey marks the confirmation of a rekey request,
+// and verified marks the friend verified, as for a request that accepts
+// one of the user's invites.
+func (r *IncomingFriendRequest) approve(rekey, verified bool) (*OutgoingFriendRequest, error) {
 	out := &OutgoingFriendRequest{
 		Username:     r.Username,
 		Confirmation: true,
 		DialRound:    r.DialRound,
+		rekey:        rekey,
+	}
+	if verified {
+		out.ExpectedKey = r.LongTermKey
+		out.verified = true
 	}
 	c := r.client
 	c.mu.Lock()
@@ -177,3 +207,219 @@ func (c *Client) GetIncomingFriendRequests() []*IncomingFriendRequest {
 	copy(r, c.incomingFriendRequests)
 	return r
 }
+
+// unexpectedKeyMatch is an incoming friend request that matches a sent
+// friend request but has a different long-term key than the user
+// expected. The add-friend protocol is held back until the application
+// calls AcceptUnexpectedKey or RejectUnexpectedKey.
+//
+//easyjson:readable
+type unexpectedKeyMatch struct {
+	Incoming *IncomingFriendRequest
+	Sent     *sentFriendRequest
+}
+
+// matchedFriendRequest completes the add-friend protocol for a matching
+// pair of friend requests, unless the incoming request's key differs from
+// the key in the sent request, in which case it calls UnexpectedSigningKey.
+func (c *Client) matchedFriendRequest(in *IncomingFriendRequest, sent *sentFriendRequest) {
+	if sent.ExpectedKey == nil || sent.ExpectedKey.Equal(in.LongTermKey) {
+		c.newFriend(in, sent)
+		return
+	}
+
+	c.mu.Lock()
+	c.removeFriendRequestsLocked(in, sent)
+	c.unexpectedKeys = append(c.unexpectedKeys, &unexpectedKeyMatch{
+		Incoming: in,
+		Sent:     sent,
+	})
+	c.mu.Unlock()
+
+	c.Handler.UnexpectedSigningKey(in, sent.outgoing())
+}
+
+func (sent *sentFriendRequest) outgoing() *OutgoingFriendRequest {
+	return &OutgoingFriendRequest{
+		Username:     sent.Username,
+		ExpectedKey:  sent.ExpectedKey,
+		Confirmation: sent.Confirmation,
+		DialRound:    sent.DialRound,
+		verified:     sent.Verified,
+		rekey:        sent.Rekey,
+
+		client: sent.client,
+	}
+}
+
+// takeUnexpectedKeyLocked removes the held match for r, returning nil if
+// there is none.
+func (c *Client) takeUnexpectedKeyLocked(r *IncomingFriendRequest) *unexpectedKeyMatch {
+	for i, m := range c.unexpectedKeys {
+		if m.Incoming == r {
+			c.unexpectedKeys = append(c.unexpectedKeys[:i], c.unexpectedKeys[i+1:]...)
+			return m
+		}
+	}
+	return nil
+}
+
+// AcceptUnexpectedKey completes the add-friend protocol for a friend
+// request that was passed to UnexpectedSigningKey, trusting the request's
+// LongTermKey instead of the key the user expected. It returns ErrTooLate
+// if the request was already accepted or rejected.
+func (r *IncomingFriendRequest) AcceptUnexpectedKey() (*Friend, error) {
+	c := r.client
+	c.mu.Lock()
+	m := c.takeUnexpectedKeyLocked(r)
+	c.mu.Unlock()
+	if m == nil {
+		return nil, ErrTooLate
+	}
+
+	friend := c.newFriend(m.Incoming, m.Sent)
+
+	c.mu.Lock()
+	err := c.persistLocked()
+	c.mu.Unlock()
+	return friend, err
+}
+
+// RejectUnexpectedKey discards a friend request that was passed to
+// UnexpectedSigningKey along with the matching sent friend request.
+// It returns ErrTooLate if the request was already accepted or rejected.
+func (r *IncomingFriendRequest) RejectUnexpectedKey() error {
+	c := r.client
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m := c.takeUnexpectedKeyLocked(r)
+	if m == nil {
+		return ErrTooLate
+	}
+	*m.Sent.DHPrivateKey = [32]byte{}
+
+	return c.persistLocked()
+}
+
+// GetUnexpectedKeyRequests returns the friend requests that were passed
+// to UnexpectedSigningKey and have not been accepted or rejected.
+func (c *Client) GetUnexpectedKeyRequests() []*IncomingFriendRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := make([]*IncomingFriendRequest, len(c.unexpectedKeys))
+	for i, m := range c.unexpectedKeys {
+		r[i] = m.Incoming
+	}
+	return r
+}
+
+// FriendRequestLifetime limits how long the client keeps incoming and
+// sent friend requests that have not turned into friendships. Each sent
+// request keeps a DH private key on disk, so expiring them restores the
+// forward secrecy of the keywheel. A request expires once it is older
+// than either non-zero limit. If both limits are zero, requests never
+// expire.
+type FriendRequestLifetime struct {
+	// Rounds is the lifetime in add-friend rounds.
+	Rounds uint32
+
+	// Duration is the lifetime in wall-clock time.
+	Duration time.Duration
+}
+
+// DefaultFriendRequestLifetime is a reasonable lifetime for applications
+// that want friend requests to expire.
+var DefaultFriendRequestLifetime = FriendRequestLifetime{
+	Duration: 7 * 24 * time.Hour,
+}
+
+func (l FriendRequestLifetime) expired(round, startRound uint32, now, start time.Time) bool {
+	if l.Rounds > 0 && round > startRound && round-startRound >= l.Rounds {
+		return true
+	}
+	if l.Duration > 0 && now.Sub(start) >= l.Duration {
+		return true
+	}
+	return false
+}
+
+// expireFriendRequests drops incoming and sent friend requests that have
+// outlived c.FriendRequestLifetime as of the given add-friend round.
+func (c *Client) expireFriendRequests(round uint32) {
+	c.mu.Lock()
+	expiredIn, expiredSent := c.expireFriendRequestsLocked(round)
+	c.mu.Unlock()
+
+	h, ok := c.Handler.(FriendRequestExpiredHandler)
+	if !ok {
+		return
+	}
+	for _, req := range expiredIn {
+		h.FriendRequestExpired(req, nil)
+	}
+	for _, req := range expiredSent {
+		h.FriendRequestExpired(nil, req.outgoing())
+	}
+}
+
+func (c *Client) expireFriendRequestsLocked(round uint32) (expiredIn []*IncomingFriendRequest, expiredSent []*sentFriendRequest) {
+	now := time.Now()
+	lifetime := c.FriendRequestLifetime
+
+	// Requests from clients that predate timestamps start aging now.
+	stampIn := func(req *IncomingFriendRequest) {
+		if req.ReceivedRound == 0 {
+			req.ReceivedRound = round
+		}
+		if req.ReceivedTime.IsZero() {
+			req.ReceivedTime = now
+		}
+	}
+	stampSent := func(req *sentFriendRequest) {
+		if req.SentTime.IsZero() {
+			req.SentTime = now
+		}
+	}
+
+	newIn := c.incomingFriendRequests[:0]
+	for _, req := range c.incomingFriendRequests {
+		stampIn(req)
+		if lifetime.expired(round, req.ReceivedRound, now, req.ReceivedTime) {
+			expiredIn = append(expiredIn, req)
+		} else {
+			newIn = append(newIn, req)
+		}
+	}
+	c.incomingFriendRequests = newIn
+
+	newSent := c.sentFriendRequests[:0]
+	for _, req := range c.sentFriendRequests {
+		stampSent(req)
+		if lifetime.expired(round, req.SentRound, now, req.SentTime) {
+			expiredSent = append(expiredSent, req)
+		} else {
+			newSent = append(newSent, req)
+		}
+	}
+	c.sentFriendRequests = newSent
+
+	// Matches held for UnexpectedSigningKey keep a DH private key too.
+	newHeld := c.unexpectedKeys[:0]
+	for _, m := range c.unexpectedKeys {
+		stampSent(m.Sent)
+		if lifetime.expired(round, m.Sent.SentRound, now, m.Sent.SentTime) {
+			expiredIn = append(expiredIn, m.Incoming)
+			expiredSent = append(expiredSent, m.Sent)
+		} else {
+			newHeld = append(newHeld, m)
+		}
+	}
+	c.unexpectedKeys = newHeld
+
+	for _, req := range expiredSent {
+		*req.DHPrivateKey = [32]byte{}
+	}
+	return expiredIn, expiredSent
+}
@@ -0,0 +1,49 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package passbox encrypts data with NaCl's secretbox using a key that is
+// usually derived from a passphrase with scrypt.
+package passbox
+
+import (
+	"crypto/rand"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Overhead is the number of bytes Seal adds to a message.
+const Overhead = 24 + secretbox.Overhead
+
+// DeriveKey derives a secretbox key from a passphrase and salt.
+func DeriveKey(passphrase []byte, salt []byte) *[32]byte {
+	dk, err := scrypt.Key(passphrase, salt, 2<<15, 8, 1, 32)
+	if err != nil {
+		panic(err)
+	}
+	key := new([32]byte)
+	copy(key[:], dk)
+	return key
+}
+
+// Seal encrypts msg with key. The result is a random nonce
+// followed by the secretbox ciphertext.
+func Seal(msg []byte, key *[32]byte) []byte {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		panic(err)
+	}
+	return secretbox.Seal(nonce[:], msg, &nonce, key)
+}
+
+// Open decrypts a ciphertext created by Seal. It returns false if
+// the ciphertext is malformed or key is wrong.
+func Open(ctxt []byte, key *[32]byte) ([]byte, bool) {
+	if len(ctxt) < Overhead {
+		return nil, false
+	}
+	var nonce [24]byte
+	copy(nonce[:], ctxt[0:24])
+	return secretbox.Open(nil, ctxt[24:], &nonce, key)
+}
@@ -0,0 +1,36 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package passbox
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	key := DeriveKey([]byte("hunter2"), []byte("salt"))
+	msg := []byte("attack at dawn")
+
+	ctxt := Seal(msg, key)
+	if len(ctxt) != len(msg)+Overhead {
+		t.Fatalf("unexpected ciphertext length: got %d, want %d", len(ctxt), len(msg)+Overhead)
+	}
+
+	got, ok := Open(ctxt, key)
+	if !ok {
+		t.Fatal("failed to open ciphertext")
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("got %q, want %q", got, msg)
+	}
+
+	wrongKey := DeriveKey([]byte("hunter3"), []byte("salt"))
+	if _, ok := Open(ctxt, wrongKey); ok {
+		t.Fatal("opened ciphertext with wrong key")
+	}
+	if _, ok := Open(ctxt[:10], key); ok {
+		t.Fatal("opened truncated ciphertext")
+	}
+}
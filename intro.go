@@ -41,7 +41,24 @@ func (i *introduction) UnmarshalBinary(data []byte) error {
 	return binary.Read(buf, binary.BigEndian, i)
 }
 
-func (i *introduction) Verify(serverKeys []*bls.PublicKey) bool {
+// Intros are signed under a prefix that marks the kind of friend
+// request they carry, which keeps the size of an intro fixed.
+var (
+	introPrefix      = []byte("Introduction")
+	rekeyIntroPrefix = []byte("RekeyIntroduction")
+)
+
+// inviteIntroPrefix is the prefix of a request that accepts an invite.
+// It includes the invite's secret, so only users who were given the
+// invite can sign such a request.
+func inviteIntroPrefix(secret []byte) []byte {
+	return append([]byte("InviteIntroduction"), secret...)
+}
+
+// Verify checks the intro's server multisig and its signature under
+// each of the prefixes in turn. It returns the index of the prefix the
+// intro was signed under, or -1 if the intro is invalid.
+func (i *introduction) Verify(serverKeys []*bls.PublicKey, prefixes ...[]byte) int {
 	longTermKey := ed25519.PublicKey(i.LongTermKey[:])
 
 	msgs := make([][]byte, len(serverKeys))
@@ -53,21 +70,26 @@ func (i *introduction) Verify(serverKeys []*bls.PublicKey) bool {
 		}
 		msgs[j] = attestation.Marshal()
 	}
-	ok1 := bls.VerifyCompressed(serverKeys, msgs, &i.ServerMultisig)
-
-	ok2 := ed25519.Verify(longTermKey, i.msg(), i.Signature[:])
+	if !bls.VerifyCompressed(serverKeys, msgs, &i.ServerMultisig) {
+		return -1
+	}
 
-	return ok1 && ok2
+	for j, prefix := range prefixes {
+		if ed25519.Verify(longTermKey, i.msg(prefix), i.Signature[:]) {
+			return j
+		}
+	}
+	return -1
 }
 
-func (i *introduction) Sign(key ed25519.PrivateKey) {
-	sig := ed25519.Sign(key, i.msg())
+func (i *introduction) Sign(key ed25519.PrivateKey, prefix []byte) {
+	sig := ed25519.Sign(key, i.msg(prefix))
 	copy(i.Signature[:], sig)
 }
 
-func (i *introduction) msg() []byte {
+func (i *introduction) msg(prefix []byte) []byte {
 	buf := new(bytes.Buffer)
-	buf.WriteString("Introduction")
+	buf.Write(prefix)
 	buf.Write(i.Username[:])
 	buf.Write(i.DHPublicKey[:])
 	binary.Write(buf, binary.BigEndian, i.DialingRound)
@@ -0,0 +1,250 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+
+	"alpenhorn/errors"
+	"alpenhorn/pkg"
+
+	"vuvuzela.io/crypto/rand"
+)
+
+const (
+	inviteVersion    byte = 0
+	inviteSecretSize      = 16
+
+	// inviteGrace is how long the client keeps an invite after it
+	// expires, so that requests sent just before the invite expired
+	// still reach the application.
+	inviteGrace = 24 * time.Hour
+)
+
+// An Invite lets a user add a friend out of band, for example by showing
+// a QR code in person. The invite carries the inviter's username and
+// long-term key, signed by that key, so the friend request sent by
+// AcceptInvite is pinned to the key and the resulting friend is verified.
+// The invite also carries a secret that the request proves knowledge
+// of, so the inviter's client approves the request without asking its
+// user and marks that friend verified too. Each invite can be accepted
+// once, so it should only be shown to one person.
+type Invite struct {
+	Username    string
+	LongTermKey ed25519.PublicKey
+	Expires     time.Time
+	Secret      []byte
+	Signature   []byte
+}
+
+// issuedInvite is what the client keeps of the invites it creates.
+//
+//easyjson:readable
+type issuedInvite struct {
+	Secret  []byte
+	Expires time.Time
+}
+
+// NewInvite returns an invite to befriend the client that expires
+// after the given lifetime.
+func (c *Client) NewInvite(lifetime time.Duration) (*Invite, error) {
+	if len(c.Username) > 255 {
+		return nil, errors.New("username too long for an invite: %q", c.Username)
+	}
+	secret := make([]byte, inviteSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	inv := &Invite{
+		Username:    c.Username,
+		LongTermKey: c.LongTermPublicKey,
+		// Drop the monotonic clock reading and sub-second precision,
+		// neither of which survive encoding.
+		Expires: time.Unix(time.Now().Add(lifetime).Unix(), 0),
+		Secret:  secret,
+	}
+	inv.Signature = ed25519.Sign(c.LongTermPrivateKey, inv.signingMessage())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	invites := c.invites[:0]
+	for _, issued := range c.invites {
+		if time.Since(issued.Expires) < inviteGrace {
+			invites = append(invites, issued)
+		}
+	}
+	c.invites = append(invites, issuedInvite{
+		Secret:  inv.Secret,
+		Expires: inv.Expires,
+	})
+	if err := c.persistLocked(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// inviteSecrets returns the secrets of the invites the client has
+// issued and not yet seen accepted.
+func (c *Client) inviteSecrets() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	secrets := make([][]byte, len(c.invites))
+	for i, issued := range c.invites {
+		secrets[i] = issued.Secret
+	}
+	return secrets
+}
+
+// useInvite removes the invite with the given secret. It returns true
+// if the invite had not expired.
+func (c *Client) useInvite(secret []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, issued := range c.invites {
+		if bytes.Equal(issued.Secret, secret) {
+			c.invites = append(c.invites[:i], c.invites[i+1:]...)
+			return time.Now().Before(issued.Expires)
+		}
+	}
+	return false
+}
+
+func (inv *Invite) body() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(inviteVersion)
+	binary.Write(buf, binary.BigEndian, inv.Expires.Unix())
+	buf.Write(inv.LongTermKey)
+	buf.Write(inv.Secret)
+	buf.WriteByte(byte(len(inv.Username)))
+	buf.WriteString(inv.Username)
+	return buf.Bytes()
+}
+
+func (inv *Invite) signingMessage() []byte {
+	return append([]byte("AlpenhornInvite"), inv.body()...)
+}
+
+// MarshalBinary returns the compact encoding of the invite, suitable as
+// a QR code payload.
+func (inv *Invite) MarshalBinary() ([]byte, error) {
+	if len(inv.Username) > 255 {
+		return nil, errors.New("username too long: %q", inv.Username)
+	}
+	if len(inv.Secret) != inviteSecretSize {
+		return nil, errors.New("invalid invite secret: %v", inv.Secret)
+	}
+	return append(inv.body(), inv.Signature...), nil
+}
+
+// UnmarshalBinary decodes an invite. It does not verify the invite.
+func (inv *Invite) UnmarshalBinary(data []byte) error {
+	const minSize = 1 + 8 + ed25519.PublicKeySize + inviteSecretSize + 1 + ed25519.SignatureSize
+	if len(data) < minSize {
+		return errors.New("invite too short: %d bytes", len(data))
+	}
+	if data[0] != inviteVersion {
+		return errors.New("unknown invite version: %d", data[0])
+	}
+	expires := int64(binary.BigEndian.Uint64(data[1:9]))
+	key := data[9 : 9+ed25519.PublicKeySize]
+	data = data[9+ed25519.PublicKeySize:]
+	secret := data[:inviteSecretSize]
+	data = data[inviteSecretSize:]
+	n := int(data[0])
+	if len(data) != 1+n+ed25519.SignatureSize {
+		return errors.New("invalid invite length")
+	}
+
+	inv.Username = string(data[1 : 1+n])
+	inv.LongTermKey = ed25519.PublicKey(append([]byte(nil), key...))
+	inv.Expires = time.Unix(expires, 0)
+	inv.Secret = append([]byte(nil), secret...)
+	inv.Signature = append([]byte(nil), data[1+n:]...)
+	return nil
+}
+
+// String returns the invite as base32 text.
+func (inv *Invite) String() string {
+	data, err := inv.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	return base32.EncodeToString(data)
+}
+
+// ParseInvite decodes an invite from its text or binary encoding and
+// verifies it. It returns an error if the invite has expired.
+func ParseInvite(token []byte) (*Invite, error) {
+	data := token
+	if text := strings.TrimSpace(string(token)); text != "" {
+		if raw, err := base32.DecodeString(strings.ToLower(text)); err == nil {
+			data = raw
+		}
+	}
+
+	inv := new(Invite)
+	if err := inv.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	if err := inv.Verify(); err != nil {
+		return nil, err
+	}
+	if time.Now().After(inv.Expires) {
+		return nil, errors.New("invite from %s expired at %s", inv.Username, inv.Expires)
+	}
+	return inv, nil
+}
+
+// Verify checks the invite's username and signature.
+func (inv *Invite) Verify() error {
+	if err := pkg.ValidateUsername(inv.Username); err != nil {
+		return err
+	}
+	if len(inv.LongTermKey) != ed25519.PublicKeySize {
+		return errors.New("invalid long-term key: %v", inv.LongTermKey)
+	}
+	if !ed25519.Verify(inv.LongTermKey, inv.signingMessage(), inv.Signature) {
+		return errors.New("invalid signature on invite from %s", inv.Username)
+	}
+	return nil
+}
+
+// AcceptInvite queues a friend request for the user who created the
+// invite. The request's ExpectedKey is pinned to the key in the invite,
+// and the inviter's client approves the request automatically. Both
+// clients mark the friend verified once the add-friend protocol
+// completes. The token is the invite's text or binary encoding.
+func (c *Client) AcceptInvite(token []byte) (*OutgoingFriendRequest, error) {
+	inv, err := ParseInvite(token)
+	if err != nil {
+		return nil, err
+	}
+	if inv.Username == c.Username {
+		return nil, errors.New("cannot accept own invite")
+	}
+
+	req := &OutgoingFriendRequest{
+		Username:    inv.Username,
+		ExpectedKey: inv.LongTermKey,
+
+		verified:     true,
+		inviteSecret: inv.Secret,
+
+		client: c,
+	}
+	c.mu.Lock()
+	c.outgoingFriendRequests = append(c.outgoingFriendRequests, req)
+	err = c.persistLocked()
+	c.mu.Unlock()
+	return req, err
+}
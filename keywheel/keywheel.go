@@ -118,6 +118,10 @@ type UserDialTokens struct {
 	Tokens       []*[32]byte
 }
 
+// IncomingDialTokens returns the dial tokens that friends would use to
+// call myUsername in the given round, for intents 0 through numIntents-1.
+// A token depends only on the shared secret, round, and intent, so the
+// tokens for an intent don't change when numIntents does.
 func (w *Wheel) IncomingDialTokens(myUsername string, round uint32, numIntents int) []*UserDialTokens {
 	w.mu.Lock()
 	defer w.mu.Unlock()
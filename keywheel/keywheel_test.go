@@ -125,6 +125,32 @@ func TestKeywheel(t *testing.T) {
 	}
 }
 
+func TestChangeNumIntents(t *testing.T) {
+	alice := "alice@example.org"
+	bob := "bob@example.org"
+	var aw, bw Wheel
+
+	abKey := new([32]byte)
+	rand.Read(abKey[:])
+	aw.Put(bob, 100, abKey)
+	bw.Put(alice, 100, abKey)
+
+	few := aw.IncomingDialTokens(alice, 100, 3)[0].Tokens
+	many := aw.IncomingDialTokens(alice, 100, 8)[0].Tokens
+	if len(few) != 3 || len(many) != 8 {
+		t.Fatalf("got %d and %d tokens, want 3 and 8", len(few), len(many))
+	}
+	for i := range few {
+		if !bytes.Equal(few[i][:], many[i][:]) {
+			t.Fatalf("token for intent %d changed with the number of intents", i)
+		}
+	}
+	tok := bw.OutgoingDialToken(alice, 100, 7)
+	if !bytes.Equal(tok[:], many[7][:]) {
+		t.Fatal("dial token mismatch for intent 7")
+	}
+}
+
 func BenchmarkGetSecret(b *testing.B) {
 	rs := &roundSecret{
 		Round:  0,
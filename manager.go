@@ -0,0 +1,186 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"alpenhorn/config"
+	"alpenhorn/edhttp"
+	"alpenhorn/errors"
+)
+
+// A Manager runs many clients in one process, for services that act for
+// several Alpenhorn identities at once. The clients share the manager's
+// config client, so each new config chain is fetched and verified once
+// for all of them, and they share one edhttp client, so they reuse
+// connections to the PKGs, CDN, and coordinators' HTTP endpoints.
+//
+// Each identity keeps its own connections to the coordinators and runs
+// its own onion schedule: in every round, each identity sends exactly the
+// onions it would send if it ran on its own, with cover traffic when it
+// has nothing to send. The coordinators accept one round's worth of onions
+// per connection, so identities can't share a coordinator connection.
+type Manager struct {
+	// ConfigClient is used by all of the manager's clients, replacing
+	// the clients' own ConfigClient.
+	ConfigClient *config.Client
+
+	initOnce     sync.Once
+	edhttpClient *edhttp.Client
+
+	mu      sync.Mutex
+	ctx     context.Context // set while Run is running
+	clients map[string]*managedClient
+}
+
+type managedClient struct {
+	client *Client
+	cancel context.CancelFunc // nil if the client is not running
+	done   chan struct{}
+}
+
+func (m *Manager) init() {
+	m.initOnce.Do(func() {
+		m.edhttpClient = new(edhttp.Client)
+		m.clients = make(map[string]*managedClient)
+	})
+}
+
+// Add adds the client to the manager. If the manager is running, Add
+// starts the client right away. The client must not be connected when it
+// is added, and applications should not call its Run, Connect, or Close
+// methods afterwards.
+func (m *Manager) Add(c *Client) error {
+	m.init()
+	if m.ConfigClient == nil {
+		return errors.New("no config client")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.clients[c.Username]; ok {
+		return errors.New("duplicate client: %s", c.Username)
+	}
+
+	c.ConfigClient = m.ConfigClient
+	c.edhttpClient = m.edhttpClient
+	c.init()
+
+	mc := &managedClient{client: c}
+	m.clients[c.Username] = mc
+	if m.ctx != nil {
+		m.startLocked(mc)
+	}
+	return nil
+}
+
+// Remove stops the client for username and removes it from the manager.
+// It waits for the client's coordinator connections to close.
+func (m *Manager) Remove(username string) error {
+	m.init()
+
+	m.mu.Lock()
+	mc, ok := m.clients[username]
+	if !ok {
+		m.mu.Unlock()
+		return errors.New("no such client: %s", username)
+	}
+	delete(m.clients, username)
+	cancel, done := mc.cancel, mc.done
+	m.mu.Unlock()
+
+	// If Run is stopping the clients, it has already canceled this one,
+	// but the client may still be running.
+	if cancel != nil {
+		cancel()
+	}
+	if done != nil {
+		<-done
+	}
+	return nil
+}
+
+// Client returns the manager's client for username, or nil if there
+// is no such client.
+func (m *Manager) Client(username string) *Client {
+	m.init()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mc, ok := m.clients[username]; ok {
+		return mc.client
+	}
+	return nil
+}
+
+// Clients returns the manager's clients sorted by username.
+func (m *Manager) Clients() []*Client {
+	m.init()
+
+	m.mu.Lock()
+	cs := make([]*Client, 0, len(m.clients))
+	for _, mc := range m.clients {
+		cs = append(cs, mc.client)
+	}
+	m.mu.Unlock()
+
+	sort.Slice(cs, func(i, j int) bool {
+		return cs[i].Username < cs[j].Username
+	})
+	return cs
+}
+
+// Run runs every client with Client.Run until ctx is canceled, including
+// clients that are added while Run is running. Run returns ctx.Err() after
+// all of the clients have stopped.
+func (m *Manager) Run(ctx context.Context) error {
+	m.init()
+
+	m.mu.Lock()
+	if m.ctx != nil {
+		m.mu.Unlock()
+		return errors.New("manager is already running")
+	}
+	m.ctx = ctx
+	for _, mc := range m.clients {
+		m.startLocked(mc)
+	}
+	m.mu.Unlock()
+
+	<-ctx.Done()
+
+	m.mu.Lock()
+	m.ctx = nil
+	running := make([]*managedClient, 0, len(m.clients))
+	for _, mc := range m.clients {
+		if mc.cancel != nil {
+			running = append(running, mc)
+			mc.cancel()
+			mc.cancel = nil
+		}
+	}
+	m.mu.Unlock()
+
+	for _, mc := range running {
+		<-mc.done
+	}
+	return ctx.Err()
+}
+
+func (m *Manager) startLocked(mc *managedClient) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	mc.cancel = cancel
+	mc.done = make(chan struct{})
+	go func() {
+		defer close(mc.done)
+		if err := mc.client.Run(ctx); err != ctx.Err() {
+			mc.client.Handler.Error(errors.Wrap(err, "running %s", mc.client.Username))
+		}
+	}()
+}
@@ -5,15 +5,191 @@
 package alpenhorn
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"encoding/json"
-	"io/ioutil"
-
-	"alpenhorn/internal/ioutil2"
+	"time"
 
 	"alpenhorn/config"
+	"alpenhorn/errors"
+	"alpenhorn/log"
 )
 
+// clientStateVersion is the current version of the client state format.
+// The client state is persisted as a version byte followed by the JSON
+// encoding of persistedState. Version 0 is the original format, which
+// was the JSON encoding without a version byte.
+const clientStateVersion byte = 9
+
+// stateMigrations[v] converts the JSON encoding of version v of the
+// client state to version v+1. Adding a field to persistedState (or the
+// types it contains) must bump clientStateVersion, so that older clients
+// refuse the new state instead of dropping the field when they persist
+// it, and add a migration here, along with a golden file in testdata for
+// the new version.
+var stateMigrations = map[byte]func(data []byte) ([]byte, error){
+	// Version 1 added the version byte but did not change the JSON.
+	0: func(data []byte) ([]byte, error) { return data, nil },
+
+	// Version 2 added timestamps to friend requests. Old requests have
+	// zero timestamps and start aging when the client is next online.
+	1: migrateState(func(st jsonObject) {
+		st.each("IncomingFriendRequests", func(req jsonObject) {
+			req.setDefault("ReceivedRound", 0)
+			req.setDefault("ReceivedTime", time.Time{})
+		})
+		st.each("SentFriendRequests", func(req jsonObject) {
+			req.setDefault("SentTime", time.Time{})
+		})
+	}),
+
+	// Version 3 added the last mailbox the client scanned for each
+	// service. Old states have none, so the client catches up starting
+	// with the next round it takes part in.
+	2: migrateState(func(st jsonObject) {
+		st.setDefault("LastAddFriendMailbox", 0)
+		st.setDefault("LastDialingMailbox", 0)
+	}),
+
+	// Version 4 added friend requests held for an unexpected key.
+	3: migrateState(func(st jsonObject) {
+		st.setDefault("UnexpectedKeys", []interface{}{})
+	}),
+
+	// Version 5 added the blocklist.
+	4: migrateState(func(st jsonObject) {
+		st.setDefault("Blocked", []interface{}{})
+	}),
+
+	// Version 6 added the verified flag to friends. Old friends are
+	// not verified.
+	5: migrateState(func(st jsonObject) {
+		st.each("Friends", func(friend jsonObject) {
+			friend.setDefault("Verified", false)
+		})
+	}),
+
+	// Version 7 added invites: the invites the client issued, and the
+	// invite that an outgoing or sent friend request accepts.
+	6: migrateState(func(st jsonObject) {
+		st.setDefault("Invites", []interface{}{})
+		st.each("OutgoingFriendRequests", func(req jsonObject) {
+			req.setDefault("Verified", false)
+			req.setDefault("InviteSecret", nil)
+		})
+		st.each("SentFriendRequests", func(req jsonObject) {
+			req.setDefault("Verified", false)
+		})
+	}),
+
+	// Version 8 added scheduled calls.
+	7: migrateState(func(st jsonObject) {
+		st.setDefault("ScheduledCalls", []interface{}{})
+	}),
+
+	// Version 9 marked friend requests made by Friend.Rekey.
+	8: migrateState(func(st jsonObject) {
+		st.each("OutgoingFriendRequests", func(req jsonObject) {
+			req.setDefault("Rekey", false)
+		})
+		st.each("SentFriendRequests", func(req jsonObject) {
+			req.setDefault("Rekey", false)
+		})
+	}),
+}
+
+// jsonObject is a JSON object decoded without a Go type, so migrations
+// don't depend on the current persistedState.
+type jsonObject map[string]interface{}
+
+// migrateState returns a migration that edits the decoded client state.
+func migrateState(edit func(st jsonObject)) func(data []byte) ([]byte, error) {
+	return func(data []byte) ([]byte, error) {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		// Keep numbers as they are written, rather than as float64s.
+		dec.UseNumber()
+		var st jsonObject
+		if err := dec.Decode(&st); err != nil {
+			return nil, err
+		}
+		edit(st)
+		return json.MarshalIndent(st, "", "  ")
+	}
+}
+
+// setDefault sets the field to v if the object does not have it.
+func (o jsonObject) setDefault(field string, v interface{}) {
+	if _, ok := o[field]; !ok {
+		o[field] = v
+	}
+}
+
+// each calls fn for each object in the array or map o[field].
+func (o jsonObject) each(field string, fn func(jsonObject)) {
+	var elems []interface{}
+	switch v := o[field].(type) {
+	case []interface{}:
+		elems = v
+	case map[string]interface{}:
+		for _, e := range v {
+			elems = append(elems, e)
+		}
+	}
+	for _, e := range elems {
+		if obj, ok := e.(map[string]interface{}); ok {
+			fn(obj)
+		}
+	}
+}
+
+func decodeClientState(data []byte) (*persistedState, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty client state")
+	}
+
+	var ver byte
+	if data[0] == '{' {
+		// Version 0 has no version byte.
+		ver = 0
+	} else {
+		ver = data[0]
+		data = data[1:]
+	}
+	if ver > clientStateVersion {
+		return nil, errors.New("client state has version %d, but this client only understands up to version %d", ver, clientStateVersion)
+	}
+
+	for ; ver < clientStateVersion; ver++ {
+		migrate, ok := stateMigrations[ver]
+		if !ok {
+			return nil, errors.New("no migration from client state version %d", ver)
+		}
+		var err error
+		data, err = migrate(data)
+		if err != nil {
+			return nil, errors.Wrap(err, "migrating client state from version %d to %d", ver, ver+1)
+		}
+	}
+
+	st := new(persistedState)
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func encodeClientState(st *persistedState) ([]byte, error) {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(clientStateVersion)
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
 //easyjson:readable
 type persistedState struct {
 	Username           string
@@ -25,9 +201,18 @@ type persistedState struct {
 	DialingConfig   *config.SignedConfig
 
 	IncomingFriendRequests []*IncomingFriendRequest
-	OutgoingFriendRequests []*OutgoingFriendRequest
+	OutgoingFriendRequests []*persistedOutgoingFriendRequest
 	SentFriendRequests     []*sentFriendRequest
+	UnexpectedKeys         []*unexpectedKeyMatch `json:",omitempty"`
 	Friends                map[string]*persistedFriend
+	Blocked                []BlockRule              `json:",omitempty"`
+	ScheduledCalls         []persistedScheduledCall `json:",omitempty"`
+	Invites                []issuedInvite           `json:",omitempty"`
+
+	// LastAddFriendMailbox and LastDialingMailbox are where the client
+	// resumes catching up on missed rounds when it restarts.
+	LastAddFriendMailbox uint32 `json:",omitempty"`
+	LastDialingMailbox   uint32 `json:",omitempty"`
 }
 
 // persistedFriend is the persisted representation of the Friend type.
@@ -38,30 +223,89 @@ type persistedFriend struct {
 	Username    string
 	LongTermKey ed25519.PublicKey
 	ExtraData   []byte
+	Verified    bool `json:",omitempty"`
+}
+
+// persistedOutgoingFriendRequest is the persisted representation of the
+// OutgoingFriendRequest type, which has unexported fields that must be
+// persisted.
+//
+//easyjson:readable
+type persistedOutgoingFriendRequest struct {
+	Username     string
+	ExpectedKey  ed25519.PublicKey
+	Confirmation bool
+	DialRound    uint32
+
+	Verified     bool   `json:",omitempty"`
+	InviteSecret []byte `json:",omitempty"`
+	Rekey        bool   `json:",omitempty"`
 }
 
 // LoadClient loads a client from persisted state at the given path.
 // You should set the client's KeywheelPersistPath before connecting.
+// LoadClient returns ErrEncrypted if the client's files are encrypted.
 func LoadClient(clientPersistPath, keywheelPersistPath string) (*Client, error) {
-	clientData, err := ioutil.ReadFile(clientPersistPath)
+	return loadClientFiles(clientPersistPath, keywheelPersistPath, nil)
+}
+
+// LoadClientFromStore is like LoadClient but loads the client from store.
+// The client continues to persist itself to store.
+func LoadClientFromStore(store StateStore) (*Client, error) {
+	return loadClientFromStore(store, nil)
+}
+
+func loadClientFiles(clientPersistPath, keywheelPersistPath string, unlock unlocker) (*Client, error) {
+	c, err := loadClient(&FileStore{
+		ClientPath:   clientPersistPath,
+		KeywheelPath: keywheelPersistPath,
+	}, unlock)
 	if err != nil {
 		return nil, err
 	}
+	c.ClientPersistPath = clientPersistPath
+	c.KeywheelPersistPath = keywheelPersistPath
+	return c, nil
+}
 
-	st := new(persistedState)
-	err = json.Unmarshal(clientData, st)
+func loadClientFromStore(store StateStore, unlock unlocker) (*Client, error) {
+	c, err := loadClient(store, unlock)
 	if err != nil {
 		return nil, err
 	}
+	c.Store = store
+	return c, nil
+}
 
-	keywheelData, err := ioutil.ReadFile(keywheelPersistPath)
+func loadClient(store StateStore, unlock unlocker) (*Client, error) {
+	clientData, err := store.Get(StateClient)
+	if err != nil {
+		return nil, err
+	}
+	clientData, persistKey, err := openFile(clientData, unlock, false)
 	if err != nil {
 		return nil, err
 	}
 
+	st, err := decodeClientState(clientData)
+	if err != nil {
+		return nil, err
+	}
+
+	keywheelData, err := store.Get(StateKeywheel)
+	if err != nil {
+		return nil, err
+	}
+	keywheelData, keywheelKey, err := openFile(keywheelData, unlock, persistKey != nil)
+	if err != nil {
+		return nil, err
+	}
+	if persistKey == nil && keywheelKey != nil {
+		return nil, ErrNotEncrypted
+	}
+
 	c := &Client{
-		ClientPersistPath:   clientPersistPath,
-		KeywheelPersistPath: keywheelPersistPath,
+		persistKey: persistKey,
 	}
 	err = c.wheel.UnmarshalBinary(keywheelData)
 	if err != nil {
@@ -85,18 +329,48 @@ func (c *Client) loadStateLocked(st *persistedState) {
 	c.dialingConfigHash = st.DialingConfig.Hash()
 
 	c.incomingFriendRequests = st.IncomingFriendRequests
-	c.outgoingFriendRequests = st.OutgoingFriendRequests
 	c.sentFriendRequests = st.SentFriendRequests
+	c.unexpectedKeys = st.UnexpectedKeys
+	c.blocked = st.Blocked
+	c.invites = st.Invites
+	c.lastAddFriendMailbox = st.LastAddFriendMailbox
+	c.lastDialingMailbox = st.LastDialingMailbox
 
 	for _, req := range c.incomingFriendRequests {
 		req.client = c
 	}
-	for _, req := range c.outgoingFriendRequests {
-		req.client = c
+	c.outgoingFriendRequests = make([]*OutgoingFriendRequest, len(st.OutgoingFriendRequests))
+	for i, req := range st.OutgoingFriendRequests {
+		c.outgoingFriendRequests[i] = &OutgoingFriendRequest{
+			Username:     req.Username,
+			ExpectedKey:  req.ExpectedKey,
+			Confirmation: req.Confirmation,
+			DialRound:    req.DialRound,
+			verified:     req.Verified,
+			inviteSecret: req.InviteSecret,
+			rekey:        req.Rekey,
+			client:       c,
+		}
 	}
 	for _, req := range c.sentFriendRequests {
 		req.client = c
 	}
+	for _, m := range c.unexpectedKeys {
+		m.Incoming.client = c
+		m.Sent.client = c
+	}
+
+	c.scheduledCalls = make([]*ScheduledCall, len(st.ScheduledCalls))
+	for i, s := range st.ScheduledCalls {
+		c.scheduledCalls[i] = &ScheduledCall{
+			Username: s.Username,
+			Intent:   s.Intent,
+			Every:    s.Every,
+			client:   c,
+			round:    s.Round,
+			next:     s.Next,
+		}
+	}
 
 	c.friends = make(map[string]*Friend, len(st.Friends))
 	for username, friend := range st.Friends {
@@ -104,12 +378,13 @@ func (c *Client) loadStateLocked(st *persistedState) {
 			Username:    friend.Username,
 			LongTermKey: friend.LongTermKey,
 			extraData:   friend.ExtraData,
+			verified:    friend.Verified,
 			client:      c,
 		}
 	}
 }
 
-// Persist writes the client's state to disk. The client persists
+// Persist writes the client's state to its store. The client persists
 // itself automatically, so Persist is only needed when creating
 // a new client.
 func (c *Client) Persist() error {
@@ -127,9 +402,129 @@ func (c *Client) persistLocked() error {
 	if e := c.persistKeywheelLocked(); err == nil {
 		err = e
 	}
+	if err == nil {
+		c.persistErr = nil
+	}
 	return err
 }
 
+// PersistError is passed to EventHandler.Error when the client fails to
+// write its state to disk during a round. Until the state is persisted,
+// the client does not take part in add-friend rounds, since they create
+// secrets (new friends and friend requests) that would be lost if the
+// application exits. The client retries persisting in the background
+// and resumes add-friend rounds once the writes succeed.
+type PersistError struct {
+	Err error
+}
+
+func (e *PersistError) Error() string {
+	return "failed to persist state: " + e.Err.Error()
+}
+
+func (e *PersistError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	minPersistRetry = 1 * time.Second
+	maxPersistRetry = 1 * time.Minute
+)
+
+// persistFailed puts the client in degraded mode after a failed write.
+func (c *Client) persistFailed(err error) {
+	c.mu.Lock()
+	report := c.persistFailedLocked(err)
+	c.mu.Unlock()
+	if report != nil {
+		c.Handler.Error(report)
+	}
+}
+
+// persistFailedLocked is like persistFailed but assumes c.mu is locked.
+// Handlers can't be called with c.mu locked, so it returns the error for
+// the caller to pass to Handler.Error after unlocking, or nil if the
+// failure was already reported.
+func (c *Client) persistFailedLocked(err error) error {
+	var report error
+	if c.persistErr == nil {
+		// Only report the first failure, not every round that fails.
+		report = &PersistError{Err: err}
+	}
+	c.persistErr = err
+
+	if !c.persistRetrying {
+		c.persistRetrying = true
+		c.persistRetryStop = make(chan struct{})
+		go c.retryPersist(c.persistRetryStop)
+	}
+	return report
+}
+
+// stopPersistRetry stops retrying a failed write. Run calls it before
+// it returns. The client retries again after its next failed write.
+func (c *Client) stopPersistRetry() {
+	c.mu.Lock()
+	if c.persistRetrying {
+		close(c.persistRetryStop)
+		c.persistRetrying = false
+		c.persistRetryStop = nil
+	}
+	c.mu.Unlock()
+}
+
+func (c *Client) retryPersist(stop chan struct{}) {
+	backoff := minPersistRetry
+	for {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		c.mu.Lock()
+		if c.persistRetryStop != stop {
+			// Stopped while waiting for the lock.
+			c.mu.Unlock()
+			return
+		}
+		if c.persistErr == nil {
+			// Some other call persisted the client.
+			c.persistRetrying = false
+			c.persistRetryStop = nil
+			c.mu.Unlock()
+			return
+		}
+		err := c.persistLocked()
+		if err == nil {
+			c.persistRetrying = false
+			c.persistRetryStop = nil
+			c.mu.Unlock()
+			log.Infof("Persisted client state; resuming add-friend rounds")
+			return
+		}
+		c.persistErr = err
+		c.mu.Unlock()
+
+		log.Warnf("Retrying persist in %s: %s", backoff, err)
+		backoff *= 2
+		if backoff > maxPersistRetry {
+			backoff = maxPersistRetry
+		}
+	}
+}
+
+// persistDegraded reports whether the client has state that it failed
+// to persist.
+func (c *Client) persistDegraded() bool {
+	c.mu.Lock()
+	degraded := c.persistErr != nil
+	c.mu.Unlock()
+	return degraded
+}
+
 func (c *Client) persistClient() error {
 	c.mu.Lock()
 	err := c.persistClientLocked()
@@ -138,7 +533,7 @@ func (c *Client) persistClient() error {
 }
 
 func (c *Client) persistClientLocked() error {
-	if c.ClientPersistPath == "" {
+	if c.Store == nil && c.ClientPersistPath == "" {
 		return nil
 	}
 
@@ -152,10 +547,37 @@ func (c *Client) persistClientLocked() error {
 		DialingConfig:   c.dialingConfig,
 
 		IncomingFriendRequests: c.incomingFriendRequests,
-		OutgoingFriendRequests: c.outgoingFriendRequests,
 		SentFriendRequests:     c.sentFriendRequests,
+		UnexpectedKeys:         c.unexpectedKeys,
 
 		Friends: make(map[string]*persistedFriend, len(c.friends)),
+		Blocked: c.blocked,
+		Invites: c.invites,
+
+		LastAddFriendMailbox: c.lastAddFriendMailbox,
+		LastDialingMailbox:   c.lastDialingMailbox,
+	}
+
+	for _, req := range c.outgoingFriendRequests {
+		st.OutgoingFriendRequests = append(st.OutgoingFriendRequests, &persistedOutgoingFriendRequest{
+			Username:     req.Username,
+			ExpectedKey:  req.ExpectedKey,
+			Confirmation: req.Confirmation,
+			DialRound:    req.DialRound,
+			Verified:     req.verified,
+			InviteSecret: req.inviteSecret,
+			Rekey:        req.rekey,
+		})
+	}
+
+	for _, s := range c.scheduledCalls {
+		st.ScheduledCalls = append(st.ScheduledCalls, persistedScheduledCall{
+			Username: s.Username,
+			Intent:   s.Intent,
+			Every:    s.Every,
+			Round:    s.round,
+			Next:     s.next,
+		})
 	}
 
 	for username, friend := range c.friends {
@@ -163,15 +585,19 @@ func (c *Client) persistClientLocked() error {
 			Username:    friend.Username,
 			LongTermKey: friend.LongTermKey,
 			ExtraData:   friend.extraData,
+			Verified:    friend.verified,
 		}
 	}
 
-	data, err := json.MarshalIndent(st, "", "  ")
+	data, err := encodeClientState(st)
 	if err != nil {
 		return err
 	}
+	if c.persistKey != nil {
+		data = c.persistKey.seal(data)
+	}
 
-	return ioutil2.WriteFileAtomic(c.ClientPersistPath, data, 0600)
+	return c.store().Put(StateClient, data)
 }
 
 func (c *Client) persistKeywheel() error {
@@ -182,7 +608,7 @@ func (c *Client) persistKeywheel() error {
 }
 
 func (c *Client) persistKeywheelLocked() error {
-	if c.KeywheelPersistPath == "" {
+	if c.Store == nil && c.KeywheelPersistPath == "" {
 		return nil
 	}
 
@@ -190,6 +616,9 @@ func (c *Client) persistKeywheelLocked() error {
 	if err != nil {
 		return err
 	}
+	if c.persistKey != nil {
+		data = c.persistKey.seal(data)
+	}
 
-	return ioutil2.WriteFileAtomic(c.KeywheelPersistPath, data, 0600)
+	return c.store().Put(StateKeywheel, data)
 }
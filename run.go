@@ -0,0 +1,169 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"context"
+	"fmt"
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	"alpenhorn/errors"
+)
+
+// ConnectionState describes the state of a connection to a coordinator.
+type ConnectionState int
+
+const (
+	// Connecting means the client is dialing the coordinator.
+	Connecting ConnectionState = iota + 1
+
+	// Connected means the client is connected to the coordinator and
+	// participating in rounds.
+	Connected
+
+	// BackingOff means the client lost its connection (or failed to
+	// connect) and is waiting before it tries again.
+	BackingOff
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case BackingOff:
+		return "backing off"
+	default:
+		return fmt.Sprintf("ConnectionState(%d)", int(s))
+	}
+}
+
+// ConnectionEvent is passed to ConnectionStateHandler.ConnectionStateChanged.
+// It is also an Event.
+type ConnectionEvent struct {
+	// Service is "AddFriend" or "Dialing".
+	Service string
+	State   ConnectionState
+
+	// Err is the reason the client is backing off. It is only set when
+	// State is BackingOff.
+	Err error
+
+	// Backoff is how long the client will wait before reconnecting.
+	// It is only set when State is BackingOff.
+	Backoff time.Duration
+}
+
+const (
+	minReconnectBackoff = 1 * time.Second
+	maxReconnectBackoff = 2 * time.Minute
+)
+
+// Run connects to the add-friend and dialing coordinators and keeps both
+// connections alive until ctx is canceled. When a connection is lost, Run
+// reconnects with jittered exponential backoff, fetching the current config
+// each time it reconnects. Connection state changes are reported through
+// the client's EventHandler.
+//
+// Run returns ctx.Err() after both connections are closed. Applications
+// that use Run should not call the Connect or Close methods.
+func (c *Client) Run(ctx context.Context) error {
+	c.init()
+
+	if c.ConfigClient == nil {
+		return errors.New("no config client")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		c.runService(ctx, "AddFriend")
+		wg.Done()
+	}()
+	go func() {
+		c.runService(ctx, "Dialing")
+		wg.Done()
+	}()
+	wg.Wait()
+	c.stopPersistRetry()
+
+	return ctx.Err()
+}
+
+// connectionStateChanged reports e to the handler if it implements
+// ConnectionStateHandler.
+func (c *Client) connectionStateChanged(e ConnectionEvent) {
+	if h, ok := c.Handler.(ConnectionStateHandler); ok {
+		h.ConnectionStateChanged(e)
+	}
+}
+
+func (c *Client) runService(ctx context.Context, service string) {
+	backoff := minReconnectBackoff
+	for {
+		c.connectionStateChanged(ConnectionEvent{
+			Service: service,
+			State:   Connecting,
+		})
+
+		conn, err := c.dialCoordinator(service)
+		if err == nil {
+			backoff = minReconnectBackoff
+			c.connectionStateChanged(ConnectionEvent{
+				Service: service,
+				State:   Connected,
+			})
+
+			disconnect := make(chan error, 1)
+			go func() {
+				disconnect <- c.serveCoordinator(service, conn)
+			}()
+
+			select {
+			case err = <-disconnect:
+			case <-ctx.Done():
+				// Close the current connection, which might not be conn
+				// if the coordinator moved.
+				c.closeConn(service)
+				<-disconnect
+				return
+			}
+			if err == nil {
+				err = errors.New("connection closed")
+			}
+		}
+
+		wait := jitter(backoff)
+		c.connectionStateChanged(ConnectionEvent{
+			Service: service,
+			State:   BackingOff,
+			Err:     err,
+			Backoff: wait,
+		})
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// jitter returns a random duration in [d/2, d) so that many clients
+// that lost their connection at the same time don't reconnect in lockstep.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(mrand.Int63n(int64(half)))
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	safetyNumberVersion = 0
+
+	// safetyNumberIterations slows down searching for a key whose
+	// fingerprint collides with another user's.
+	safetyNumberIterations = 5200
+
+	sizeFingerprint = 30
+)
+
+// A SafetyNumber is a fingerprint of the usernames and long-term keys of
+// two friends. Both friends compute the same safety number, so they can
+// compare them out of band (in person or over a trusted channel) to check
+// that neither key was substituted. See Friend.SafetyNumber.
+type SafetyNumber struct {
+	// fingerprints are ordered by username so both sides agree.
+	fingerprints [2][]byte
+}
+
+// SafetyNumber returns the safety number for the friend and the client.
+func (f *Friend) SafetyNumber() *SafetyNumber {
+	me := fingerprint(f.client.Username, f.client.LongTermPublicKey)
+	them := fingerprint(f.Username, f.LongTermKey)
+	if f.client.Username < f.Username {
+		return &SafetyNumber{fingerprints: [2][]byte{me, them}}
+	}
+	return &SafetyNumber{fingerprints: [2][]byte{them, me}}
+}
+
+func fingerprint(username string, key ed25519.PublicKey) []byte {
+	h := sha512.New()
+	var ver [2]byte
+	binary.BigEndian.PutUint16(ver[:], safetyNumberVersion)
+	h.Write(ver[:])
+	h.Write(key)
+	h.Write([]byte(username))
+	sum := h.Sum(nil)
+	for i := 0; i < safetyNumberIterations; i++ {
+		h.Reset()
+		h.Write(sum)
+		h.Write(key)
+		sum = h.Sum(sum[:0])
+	}
+	return sum[:sizeFingerprint]
+}
+
+// Digits returns the safety number as 60 digits in groups of five.
+// Each friend's half of the digits comes from their own key, so users
+// can read the number aloud to each other.
+func (n *SafetyNumber) Digits() string {
+	groups := make([]string, 0, 12)
+	for _, fp := range n.fingerprints {
+		for i := 0; i < len(fp); i += 5 {
+			var chunk [8]byte
+			copy(chunk[3:], fp[i:i+5])
+			groups = append(groups, fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk[:])%100000))
+		}
+	}
+	return strings.Join(groups, " ")
+}
+
+func (n *SafetyNumber) String() string {
+	return n.Digits()
+}
+
+// QRPayload returns the safety number in a form suitable for encoding
+// as a QR code. The friend can scan the code and call MatchesQR.
+func (n *SafetyNumber) QRPayload() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(safetyNumberVersion)
+	buf.Write(n.fingerprints[0])
+	buf.Write(n.fingerprints[1])
+	return buf.Bytes()
+}
+
+// MatchesQR returns true if the payload, scanned from the friend's QR
+// code, matches this safety number.
+func (n *SafetyNumber) MatchesQR(payload []byte) bool {
+	return subtle.ConstantTimeCompare(n.QRPayload(), payload) == 1
+}
+
+// Verified returns true if the user marked the friend as verified.
+// The flag is cleared if the friend's long-term key changes.
+func (f *Friend) Verified() bool {
+	f.client.mu.Lock()
+	defer f.client.mu.Unlock()
+	return f.verified
+}
+
+// SetVerified records whether the user checked the friend's safety
+// number out of band.
+func (f *Friend) SetVerified(verified bool) error {
+	f.client.mu.Lock()
+	defer f.client.mu.Unlock()
+	f.verified = verified
+	return f.client.persistLocked()
+}
@@ -0,0 +1,160 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"time"
+
+	"alpenhorn/errors"
+)
+
+// A ScheduledCall is a call that the client places on its own when it
+// is due, for example a daily check-in with a friend. Scheduled calls
+// are persisted with the client state.
+type ScheduledCall struct {
+	Username string
+	Intent   int
+
+	// Every is the interval between calls, or zero for a one-time call.
+	Every time.Duration
+
+	client *Client
+	// round is the dialing round the call is due in, or zero if the
+	// call is due at the wall-clock time next.
+	round uint32
+	next  time.Time
+}
+
+// persistedScheduledCall is the persisted representation of the
+// ScheduledCall type.
+//
+//easyjson:readable
+type persistedScheduledCall struct {
+	Username string
+	Intent   int
+	Every    time.Duration `json:",omitempty"`
+	Round    uint32        `json:",omitempty"`
+	Next     time.Time
+}
+
+// ScheduleCall schedules a call to the friend at the given time. If every
+// is nonzero, the call repeats at that interval. The call is placed in
+// the first dialing round after it is due. If the client is offline for
+// several intervals, it places one call when it reconnects rather than
+// one for each interval it missed. A call placed just before the client
+// exits may be placed again when it restarts.
+func (f *Friend) ScheduleCall(intent int, at time.Time, every time.Duration) (*ScheduledCall, error) {
+	if every < 0 {
+		return nil, errors.New("invalid call interval: %s", every)
+	}
+	return f.schedule(&ScheduledCall{
+		Username: f.Username,
+		Intent:   intent,
+		Every:    every,
+		next:     at,
+	})
+}
+
+// ScheduleCallForRound schedules a one-time call to the friend in the
+// given dialing round, or the first round after it that the client
+// takes part in.
+func (f *Friend) ScheduleCallForRound(intent int, round uint32) (*ScheduledCall, error) {
+	if round == 0 {
+		return nil, errors.New("invalid round: 0")
+	}
+	return f.schedule(&ScheduledCall{
+		Username: f.Username,
+		Intent:   intent,
+		round:    round,
+	})
+}
+
+func (f *Friend) schedule(s *ScheduledCall) (*ScheduledCall, error) {
+	c := f.client
+	if s.Intent < 0 || s.Intent >= c.NumIntents() {
+		return nil, ErrInvalidIntent
+	}
+	if !c.wheel.Exists(f.Username) {
+		return nil, errors.New("no keywheel entry for %s", f.Username)
+	}
+
+	s.client = c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scheduledCalls = append(c.scheduledCalls, s)
+	return s, c.persistLocked()
+}
+
+// GetScheduledCalls returns the client's scheduled calls.
+func (c *Client) GetScheduledCalls() []*ScheduledCall {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	calls := make([]*ScheduledCall, len(c.scheduledCalls))
+	copy(calls, c.scheduledCalls)
+	return calls
+}
+
+// Next returns when the call is next due: either a dialing round,
+// or a wall-clock time if the round is zero.
+func (s *ScheduledCall) Next() (round uint32, t time.Time) {
+	s.client.mu.Lock()
+	defer s.client.mu.Unlock()
+	return s.round, s.next
+}
+
+// Cancel removes the scheduled call, returning ErrTooLate if a one-time
+// call was already placed or the call was already cancelled.
+func (s *ScheduledCall) Cancel() error {
+	c := s.client
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, t := range c.scheduledCalls {
+		if t == s {
+			c.scheduledCalls = append(c.scheduledCalls[:i], c.scheduledCalls[i+1:]...)
+			return c.persistLocked()
+		}
+	}
+	return ErrTooLate
+}
+
+func (s *ScheduledCall) due(round uint32, now time.Time) bool {
+	if s.round != 0 {
+		return round >= s.round
+	}
+	return !now.Before(s.next)
+}
+
+// nextScheduledCallLocked returns a call for the first scheduled call
+// that is due, or nil if none are.
+func (c *Client) nextScheduledCallLocked(round uint32) *OutgoingCall {
+	now := time.Now()
+	for i, s := range c.scheduledCalls {
+		if !s.due(round, now) {
+			continue
+		}
+
+		if s.Every == 0 {
+			c.scheduledCalls = append(c.scheduledCalls[:i], c.scheduledCalls[i+1:]...)
+		} else {
+			// Skip intervals that passed while the client was offline.
+			n := now.Sub(s.next)/s.Every + 1
+			s.next = s.next.Add(n * s.Every)
+		}
+		// The change is not persisted here: writing to disk only in rounds
+		// where a scheduled call goes out would reveal when the client
+		// places calls. It reaches disk with the client's next write, such
+		// as the one at the end of every add-friend round.
+
+		return &OutgoingCall{
+			Username: s.Username,
+			Created:  now,
+			client:   c,
+			intent:   s.Intent,
+		}
+	}
+	return nil
+}
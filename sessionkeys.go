@@ -0,0 +1,77 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// maxDerivedKeys is the most keys HKDF-SHA256 can derive at once.
+const maxDerivedKeys = 255
+
+// DeriveKeys derives n independent 32-byte keys from the call's session
+// key for the application protocol named by label, such as
+// "vuvuzela-convo". It returns nil if the call has not been sent yet,
+// or if n is not between 0 and 255.
+// See deriveKeys for the derivation, which the caller and callee both
+// compute the same way.
+func (r *OutgoingCall) DeriveKeys(label string, n int) []*[32]byte {
+	sessionKey := r.SessionKey()
+	if sessionKey == nil {
+		return nil
+	}
+	r.client.mu.Lock()
+	round, intent := r.sentRound, r.intent
+	r.client.mu.Unlock()
+	return deriveKeys(sessionKey, r.client.Username, r.Username, round, intent, label, n)
+}
+
+// DeriveKeys is like OutgoingCall.DeriveKeys. It returns the same keys
+// as the caller's OutgoingCall.
+func (r *IncomingCall) DeriveKeys(label string, n int) []*[32]byte {
+	return deriveKeys(r.SessionKey, r.Username, r.callee, r.round, r.Intent, label, n)
+}
+
+// deriveKeys expands the session key with HKDF-SHA256. The HKDF info
+// binds the label, both usernames in the order caller then callee, the
+// dialing round, and the intent:
+//
+//	"AlpenhornDeriveKeys" || str(label) || str(caller) || str(callee) ||
+//	    uint32(round) || uint32(intent)
+//
+// where str(s) is the length of s as a big-endian uint32 followed by s.
+// The salt is empty. The i'th key is bytes 32*i to 32*(i+1) of the
+// HKDF output. testdata/derivekeys.json has test vectors.
+//
+// deriveKeys returns nil if n is more keys than HKDF can derive.
+func deriveKeys(sessionKey *[32]byte, caller, callee string, round uint32, intent int, label string, n int) []*[32]byte {
+	if n < 0 || n > maxDerivedKeys {
+		return nil
+	}
+
+	info := new(bytes.Buffer)
+	info.WriteString("AlpenhornDeriveKeys")
+	for _, s := range []string{label, caller, callee} {
+		binary.Write(info, binary.BigEndian, uint32(len(s)))
+		info.WriteString(s)
+	}
+	binary.Write(info, binary.BigEndian, round)
+	binary.Write(info, binary.BigEndian, uint32(intent))
+
+	kdf := hkdf.New(sha256.New, sessionKey[:], nil, info.Bytes())
+	keys := make([]*[32]byte, n)
+	for i := range keys {
+		keys[i] = new([32]byte)
+		if _, err := io.ReadFull(kdf, keys[i][:]); err != nil {
+			panic(err)
+		}
+	}
+	return keys
+}
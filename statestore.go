@@ -0,0 +1,147 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"alpenhorn/errors"
+	"alpenhorn/internal/ioutil2"
+)
+
+// Names of the state that a client keeps in its StateStore.
+const (
+	// StateClient is the client's long-term state: its keys, configs,
+	// friends, and friend requests. It should be backed up.
+	StateClient = "client"
+
+	// StateKeywheel is the client's keywheel. It should not be backed
+	// up; see Client.KeywheelPersistPath.
+	StateKeywheel = "keywheel"
+
+	// StateCallLog is the client's call history.
+	StateCallLog = "calls"
+)
+
+// A StateStore holds the state that a client persists. The client
+// encrypts the state before storing it if it has a passphrase or key.
+type StateStore interface {
+	// Get returns the state stored under name. If there is none,
+	// Get returns an error for which os.IsNotExist is true.
+	Get(name string) ([]byte, error)
+
+	// Put replaces the state stored under name. A crash during Put
+	// must leave either the old or the new state in the store.
+	Put(name string, data []byte) error
+
+	// Delete removes the state stored under name. It is not an error
+	// to delete state that does not exist.
+	Delete(name string) error
+}
+
+// store returns the client's state store, which is a FileStore for the
+// client's persist paths if Store is nil.
+func (c *Client) store() StateStore {
+	if c.Store != nil {
+		return c.Store
+	}
+	return &FileStore{
+		ClientPath:   c.ClientPersistPath,
+		KeywheelPath: c.KeywheelPersistPath,
+		CallLogPath:  c.CallLogPersistPath,
+	}
+}
+
+// FileStore is a StateStore that keeps each kind of state in its own
+// file, which it replaces atomically. Clients use a FileStore for their
+// persist paths if Client.Store is nil. State whose path is empty is
+// not persisted.
+type FileStore struct {
+	ClientPath   string
+	KeywheelPath string
+	CallLogPath  string
+}
+
+func (s *FileStore) path(name string) (string, error) {
+	switch name {
+	case StateClient:
+		return s.ClientPath, nil
+	case StateKeywheel:
+		return s.KeywheelPath, nil
+	case StateCallLog:
+		return s.CallLogPath, nil
+	}
+	return "", errors.New("unknown state: %q", name)
+}
+
+func (s *FileStore) Get(name string) ([]byte, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return nil, &os.PathError{Op: "get", Path: name, Err: os.ErrNotExist}
+	}
+	return ioutil.ReadFile(path)
+}
+
+func (s *FileStore) Put(name string, data []byte) error {
+	path, err := s.path(name)
+	if err != nil || path == "" {
+		return err
+	}
+	return ioutil2.WriteFileAtomic(path, data, 0600)
+}
+
+func (s *FileStore) Delete(name string) error {
+	path, err := s.path(name)
+	if err != nil || path == "" {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// MemoryStore is a StateStore that keeps state in memory, for tests and
+// for applications that save the state some other way. The zero value
+// is an empty store.
+type MemoryStore struct {
+	mu    sync.Mutex
+	state map[string][]byte
+}
+
+func (s *MemoryStore) Get(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.state[name]
+	if !ok {
+		return nil, &os.PathError{Op: "get", Path: name, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (s *MemoryStore) Put(name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == nil {
+		s.state = make(map[string][]byte)
+	}
+	s.state[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *MemoryStore) Delete(name string) error {
+	s.mu.Lock()
+	delete(s.state, name)
+	s.mu.Unlock()
+	return nil
+}